@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockRequest describes a set of locks to acquire all at once, and how to hold them
+type lockRequest struct {
+	Names        []string
+	Token        string
+	Mode         string
+	Permits      int
+	Priority     int
+	Lease        time.Duration
+	MaxHold      time.Duration
+	Scope        string
+	Hierarchical bool
+
+	// Wait is whether the request keeps its place in line for the locks it couldn't
+	// acquire. Requests that don't wait give up as soon as the locks are held.
+	Wait bool
+
+	// Backoff decides how long to wait between attempts while the locks are held
+	Backoff *backoff
+
+	// RetryBudget is how long to keep trying again while the backend is throttling us
+	// or failing, see retryTransient
+	RetryBudget time.Duration
+}
+
+// lockAttempt is the outcome of a single attempt at acquiring the locks of a request
+type lockAttempt struct {
+	// Acquired is whether all of the locks were acquired
+	Acquired bool
+
+	// Owner is the token the locks are held under. It's the token of the request,
+	// unless the locks were re-entered through another owner in the same scope.
+	Owner string
+
+	// Fences are the fencing tokens of each of the locks, in the same order as the names
+	Fences []int64
+
+	// HoldUntil is when the first of the locks can be broken by waiters because we
+	// exceeded our max-hold, in epoch seconds. 0 means there's no maximum.
+	HoldUntil int64
+
+	// Waiting describes each of the locks that are still being waited for
+	Waiting []string
+}
+
+// fence returns the fencing tokens of the locks, separated by commas
+func (a *lockAttempt) fence() string {
+	var fences []string
+	for _, fence := range a.Fences {
+		fences = append(fences, strconv.FormatInt(fence, 10))
+	}
+	return strings.Join(fences, ",")
+}
+
+// holdUntil keeps track of the earliest max-hold deadline among the locks
+func (a *lockAttempt) holdUntil(deadline int64) {
+	if deadline != 0 && (a.HoldUntil == 0 || deadline < a.HoldUntil) {
+		a.HoldUntil = deadline
+	}
+}
+
+// lockAncestors returns every lock above name in the hierarchy, starting at the top
+func lockAncestors(name string) []string {
+	var ancestors []string
+	segments := strings.Split(name, "/")
+	for i := 1; i < len(segments); i++ {
+		ancestors = append(ancestors, strings.Join(segments[:i], "/"))
+	}
+	return ancestors
+}
+
+// lockItems returns the names of every lock item that's involved in holding names.
+// Hierarchical locks also involve every lock above them.
+func lockItems(names []string, hierarchical bool) []string {
+	if !hierarchical {
+		return names
+	}
+
+	var items []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		for _, item := range append(lockAncestors(name), name) {
+			if !seen[item] {
+				seen[item] = true
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// validate checks that the request can be acquired at all
+func (r *lockRequest) validate() error {
+	if r.Lease < 0 {
+		return fmt.Errorf("%s must not be negative, got %v", LockLeaseVar, r.Lease)
+	}
+	if r.MaxHold < 0 {
+		return fmt.Errorf("%s must not be negative, got %v", LockMaxHoldVar, r.MaxHold)
+	}
+	if r.Permits < 1 {
+		return fmt.Errorf("%s must be at least 1, got %d", LockPermitsVar, r.Permits)
+	}
+	if r.Mode != ModeExclusive && r.Mode != ModeShared {
+		return fmt.Errorf("unknown %s %q, expected %q or %q", LockModeVar, r.Mode, ModeShared, ModeExclusive)
+	}
+	if r.RetryBudget < 0 {
+		return fmt.Errorf("%s must not be negative, got %v", LockRetryBudgetVar, r.RetryBudget)
+	}
+	if r.Wait {
+		if err := r.Backoff.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Hierarchical {
+		for _, name := range r.Names {
+			for _, other := range r.Names {
+				if strings.HasPrefix(name, other+"/") {
+					return fmt.Errorf("%s is below %s, which is already part of the same request", name, other)
+				}
+			}
+		}
+	}
+
+	if items := lockItems(r.Names, r.Hierarchical); len(items) > MaxLockNames {
+		return fmt.Errorf("can't lock %d names along with the locks above them at once, at most %d locks can be acquired in a single DynamoDB transaction", len(items), MaxLockNames)
+	}
+	return nil
+}
+
+// attempt tries to acquire all of the locks of the request, given their current state
+// along with the state of every lock above them when they're hierarchical. When the
+// locks can't be acquired yet, the request keeps its place in line for each of them.
+func (r *lockRequest) attempt(states map[string]*lockState, now time.Time) (*lockAttempt, error) {
+	// A lease that ran out without being released frees up its permit, and so does a
+	// holder that held on to the lock for longer than it said it would
+	for _, name := range lockItems(r.Names, r.Hierarchical) {
+		for token, holder := range states[name].prune(now.Unix()) {
+			if holder.overdue(now.Unix()) {
+				log.Printf("Breaking lock %s of owner %s, which exceeded its max-hold of %s", name, token, holder.MaxHold)
+				continue
+			}
+			log.Printf("Lease of owner %s on lock %s has expired", token, name)
+		}
+	}
+	var expiresAt, holdUntil int64
+	if r.Lease > 0 {
+		expiresAt = now.Add(r.Lease).Unix()
+	}
+	if r.MaxHold > 0 {
+		holdUntil = now.Add(r.MaxHold).Unix()
+	}
+
+	// Locks that are already held by an owner in our reentrancy scope are entered
+	// again instead of waited for. We take over that owner's token, so that the holds
+	// are counted on the same holder and the lock is only released by whichever of us
+	// lets go of it last.
+	result := &lockAttempt{Owner: r.Token}
+	for _, name := range r.Names {
+		token := states[name].reentrant(r.Scope, r.Mode)
+		if token == "" {
+			continue
+		}
+		if result.Owner != r.Token && result.Owner != token {
+			return nil, errScopeConflict
+		}
+		result.Owner = token
+	}
+	owner := result.Owner
+	if owner != r.Token {
+		r.abandon(states, r.Token)
+	}
+	var pending []string
+	for _, name := range r.Names {
+		if _, ok := states[name].Holders[owner]; !ok {
+			pending = append(pending, name)
+		}
+	}
+
+	// Waiting owners get the lock in order of priority and then in the order they
+	// first asked for it, refreshing their tickets every time they try again. Tickets
+	// are taken on all of the locks in the same write, so that owners waiting for the
+	// same locks are queued in the same order on each of them. That stops being true
+	// once one of our tickets was given up on, so then we start over at the back of
+	// every queue. Hierarchical locks also take a ticket on every lock above them, so
+	// that whoever waits there and asked first gets its turn first.
+	for _, name := range pending {
+		if _, ok := states[name].Queue[owner]; !ok {
+			r.abandon(states, owner)
+			break
+		}
+	}
+	result.Acquired = true
+	for _, name := range pending {
+		state := states[name]
+		state.enqueue(owner, r.Mode, r.Priority, now.Add(TicketLease).Unix())
+		if r.Hierarchical {
+			for _, ancestor := range lockAncestors(name) {
+				states[ancestor].waitBelow(owner, r.Mode, r.Priority, now.Add(TicketLease).Unix())
+			}
+		}
+	}
+	for _, name := range pending {
+		state := states[name]
+		if !state.admits(owner, r.Mode, r.Permits) || (r.Hierarchical && !r.admitsHierarchy(states, name, owner)) {
+			result.Acquired = false
+		}
+	}
+
+	if !result.Acquired {
+		for _, name := range pending {
+			state := states[name]
+			status := fmt.Sprintf("%s at position %d of %d in the queue, held by %d owners", name, state.position(owner), len(state.Queue), len(state.Holders))
+			if r.Hierarchical {
+				status += fmt.Sprintf(" and %d owners below it", len(state.Intents))
+			}
+			result.Waiting = append(result.Waiting, status)
+		}
+		if !r.Wait {
+			r.abandon(states, owner)
+		}
+		return result, nil
+	}
+	r.abandon(states, owner)
+
+	for _, name := range r.Names {
+		state := states[name]
+		if holder, ok := state.Holders[owner]; ok && owner == r.Token {
+			// We only hold a lock under our own token already when an earlier attempt
+			// of ours was written after all, even though it looked like it failed
+			result.Fences = append(result.Fences, holder.Fence)
+			result.holdUntil(holder.HoldUntil)
+			continue
+		}
+		if _, ok := state.Holders[owner]; ok {
+			holder := state.reenter(owner, expiresAt, holdUntil)
+			log.Printf("Re-entered lock %s held by owner %s, it's now held %d times", name, owner, holder.Holds)
+			result.Fences = append(result.Fences, holder.Fence)
+			result.holdUntil(holder.HoldUntil)
+			continue
+		}
+
+		holder := ownerMetadata()
+		holder.AcquiredAt = now.UTC().Format(time.RFC3339)
+		holder.Mode = r.Mode
+		holder.ExpiresAt = expiresAt
+		holder.HoldUntil = holdUntil
+		if r.MaxHold > 0 {
+			holder.MaxHold = r.MaxHold.String()
+		}
+		holder.Scope = r.Scope
+		state.grant(owner, holder)
+		if r.Hierarchical {
+			for _, ancestor := range lockAncestors(name) {
+				states[ancestor].addIntent(owner, r.Mode, holder.deadline())
+			}
+		}
+		result.Fences = append(result.Fences, holder.Fence)
+		result.holdUntil(holder.HoldUntil)
+	}
+	return result, nil
+}
+
+// admitsHierarchy reports whether owner can hold name without conflicting with the
+// holders of any lock above or below it in the hierarchy
+func (r *lockRequest) admitsHierarchy(states map[string]*lockState, name, owner string) bool {
+	if !states[name].admitsAbove(owner, r.Mode) {
+		return false
+	}
+	for _, ancestor := range lockAncestors(name) {
+		if !states[ancestor].admitsBelow(owner, r.Mode) {
+			return false
+		}
+	}
+	return true
+}
+
+// abandon gives up the places in line that owner took for the request, including
+// the ones on the locks above them, and reports whether it was waiting for any of the
+// locks
+func (r *lockRequest) abandon(states map[string]*lockState, owner string) bool {
+	abandoned := false
+	for _, name := range r.Names {
+		if states[name].dequeue(owner) {
+			abandoned = true
+		}
+		if !r.Hierarchical {
+			continue
+		}
+		for _, ancestor := range lockAncestors(name) {
+			if states[ancestor].stopWaitingBelow(owner) {
+				abandoned = true
+			}
+		}
+	}
+	return abandoned
+}
+
+// releaseLocks takes away a hold on each of names from token, along with its intents
+// on the locks above them once the last hold is gone, and reports whether token held
+// any of the locks
+func releaseLocks(states map[string]*lockState, names []string, token string, hierarchical bool) bool {
+	released := false
+	for _, name := range names {
+		state := states[name]
+		if !state.release(token) {
+			continue
+		}
+		released = true
+		if _, ok := state.Holders[token]; hierarchical && !ok {
+			for _, ancestor := range lockAncestors(name) {
+				states[ancestor].removeIntent(token)
+			}
+		}
+	}
+	return released
+}
+
+// renewLocks pushes out the lease of token on each of names until expiresAt, along
+// with its intents on the locks above them, and returns when the first of the locks
+// can be broken, since renewing doesn't extend a max-hold
+func renewLocks(states map[string]*lockState, names []string, token string, hierarchical bool, expiresAt int64) (int64, error) {
+	deadline := expiresAt
+	for _, name := range names {
+		holder, ok := states[name].Holders[token]
+		if !ok {
+			return 0, errNotHolder
+		}
+		holder.ExpiresAt = expiresAt
+		if holder.deadline() < deadline {
+			deadline = holder.deadline()
+		}
+		if hierarchical {
+			for _, ancestor := range lockAncestors(name) {
+				if intent, ok := states[ancestor].Intents[token]; ok {
+					intent.ExpiresAt = holder.deadline()
+				}
+			}
+		}
+	}
+	return deadline, nil
+}
+
+// acquireLocks keeps attempting to acquire all of the locks of the request until it
+// succeeds, or until timeout runs out and it gives up its place in line. A request
+// that doesn't wait only makes a single attempt, and returns errLockHeld when the
+// locks are held. When ctx is cancelled, the request gives up on the locks it was
+// waiting for or might have just acquired, and returns the error of ctx. All of the
+// waiting happens on clock.
+func acquireLocks(ctx context.Context, locker Locker, request *lockRequest, timeout time.Duration, clock clock) (*lockAttempt, error) {
+	deadline := clock.Now().Add(timeout)
+	var waiting []string
+	log.Println("Acquiring lock")
+	for {
+		var attempt *lockAttempt
+		err := retryTransient(ctx, request.RetryBudget, clock, func() error {
+			var err error
+			attempt, err = locker.Acquire(ctx, request, clock.Now())
+			return err
+		})
+		if ctx.Err() != nil {
+			// We can't tell whether an attempt that was cancelled while it was being
+			// written acquired the locks, so we release them in case it did
+			if attempt == nil {
+				attempt = &lockAttempt{Acquired: true, Owner: request.Token}
+			}
+			abandonLocks(locker, request, attempt.Owner, attempt.Acquired)
+			return nil, ctx.Err()
+		}
+		if err == errVersionConflict && request.Wait {
+			// Everyone else writing the locks at the same time is just another way
+			// of them being busy, so we wait our turn like we would for the holders
+			log.Print("Lock kept changing while trying to acquire it")
+			attempt = &lockAttempt{Owner: request.Token, Waiting: waiting}
+		} else if err != nil {
+			return nil, err
+		}
+		if attempt.Acquired {
+			log.Printf("Lock acquired with fencing token %s", attempt.fence())
+			return attempt, nil
+		}
+		if !request.Wait {
+			for _, status := range attempt.Waiting {
+				log.Printf("Not waiting for lock %s", status)
+			}
+			return nil, errLockHeld
+		}
+
+		// Whenever the holders or the queue changed, the lock might be ours soon, so
+		// we start over with short waits instead of sleeping through our turn
+		if strings.Join(attempt.Waiting, "\n") != strings.Join(waiting, "\n") {
+			request.Backoff.reset()
+		}
+		waiting = attempt.Waiting
+		wait := request.Backoff.next()
+		if remaining := deadline.Sub(clock.Now()); wait > remaining {
+			wait = remaining
+		}
+		for _, status := range attempt.Waiting {
+			log.Printf("Waiting for lock %s in %s mode with priority %d, trying again in %v", status, request.Mode, request.Priority, wait.Round(time.Millisecond))
+		}
+
+		var changed <-chan struct{}
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		if watcher, ok := locker.(lockWatcher); ok {
+			changed = watcher.Watch(watchCtx, request)
+		}
+		select {
+		case <-ctx.Done():
+			stopWatching()
+			abandonLocks(locker, request, attempt.Owner, false)
+			return nil, ctx.Err()
+		case <-clock.After(wait):
+		case <-changed:
+			log.Print("Lock changed, trying again right away")
+		}
+		stopWatching()
+		if !clock.Now().Before(deadline) {
+			abandonLocks(locker, request, attempt.Owner, false)
+			return nil, errLockTimeout
+		}
+	}
+}
+
+// abandonLocks makes a best effort at giving up the places in line of owner, and with
+// release also the holds it was granted for the request. It gets CleanupTimeout to do
+// so, regardless of whether we were cancelled already. Locks that owner doesn't hold
+// or wait for are left alone.
+func abandonLocks(locker Locker, request *lockRequest, owner string, release bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), CleanupTimeout)
+	defer cancel()
+
+	err := locker.Release(ctx, request, owner, release)
+	if err != nil && err != errNotHolder {
+		log.Printf("Failed to give up on lock: %+v", err)
+	}
+}
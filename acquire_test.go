@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves forward when the acquisition loop waits on it. Every wait
+// passes right away, after running onWait, so that tests can change the locks while
+// the loop is waiting. Once blocked, waits never pass at all.
+type fakeClock struct {
+	now     time.Time
+	waits   []time.Duration
+	onWait  func()
+	blocked bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	if c.onWait != nil {
+		c.onWait()
+	}
+	if c.blocked {
+		return nil
+	}
+	passed := make(chan time.Time, 1)
+	passed <- c.now
+	return passed
+}
+
+// testRequest returns a request for an exclusive lock on names that waits for it
+func testRequest(token string, names ...string) *lockRequest {
+	return &lockRequest{
+		Names:   names,
+		Token:   token,
+		Mode:    ModeExclusive,
+		Permits: 1,
+		Lease:   time.Minute,
+		Wait:    true,
+		Backoff: newBackoff(BackoffFixed, 100*time.Millisecond, time.Second, 2, rand.New(rand.NewSource(1))),
+	}
+}
+
+// mustAcquire acquires the locks of request in a single attempt
+func mustAcquire(t *testing.T, locker Locker, request *lockRequest, clock clock) {
+	t.Helper()
+	request.Wait = false
+	if _, err := acquireLocks(context.Background(), locker, request, time.Minute, clock); err != nil {
+		t.Fatalf("acquiring %v as %s: %v", request.Names, request.Token, err)
+	}
+}
+
+// holders returns the tokens holding name
+func holders(t *testing.T, locker Locker, name string) []string {
+	t.Helper()
+	states, err := locker.Inspect(context.Background(), []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for token := range states[name].Holders {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func TestAcquireLocksTryLock(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	mustAcquire(t, locker, testRequest("first", "deploy"), clock)
+
+	request := testRequest("second", "deploy")
+	request.Wait = false
+	_, err := acquireLocks(context.Background(), locker, request, time.Minute, clock)
+	if err != errLockHeld {
+		t.Fatalf("expected %v, got %v", errLockHeld, err)
+	}
+	if len(clock.waits) != 0 {
+		t.Errorf("expected a single attempt without waiting, waited %v", clock.waits)
+	}
+
+	// Not waiting leaves no ticket behind that would hold up anyone else
+	if err := locker.Release(context.Background(), testRequest("first", "deploy"), "first", true); err != nil {
+		t.Fatal(err)
+	}
+	mustAcquire(t, locker, testRequest("third", "deploy"), clock)
+}
+
+func TestAcquireLocksFIFO(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	mustAcquire(t, locker, testRequest("first", "deploy"), clock)
+
+	// Once second is waiting, third gets in line behind it, and then the lock is
+	// released. Third must not be let in ahead of second.
+	third := testRequest("third", "deploy")
+	clock.onWait = func() {
+		clock.onWait = nil
+		attempt, err := locker.Acquire(context.Background(), third, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Acquired {
+			t.Fatal("third acquired the lock while it was held")
+		}
+		if err := locker.Release(context.Background(), testRequest("first", "deploy"), "first", true); err != nil {
+			t.Fatal(err)
+		}
+		attempt, err = locker.Acquire(context.Background(), third, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Acquired {
+			t.Fatal("third acquired the lock ahead of second, which was waiting longer")
+		}
+	}
+	if _, err := acquireLocks(context.Background(), locker, testRequest("second", "deploy"), time.Minute, clock); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, locker, "deploy"); len(got) != 1 || got[0] != "second" {
+		t.Errorf("expected deploy to be held by second, got %v", got)
+	}
+}
+
+func TestAcquireLocksPriority(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	mustAcquire(t, locker, testRequest("first", "deploy"), clock)
+
+	// Second got in line first, but urgent has a higher priority and goes ahead of
+	// it once the lock is released
+	second := testRequest("second", "deploy")
+	attempt, err := locker.Acquire(context.Background(), second, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.Acquired {
+		t.Fatal("second acquired the lock while it was held")
+	}
+	clock.onWait = func() {
+		clock.onWait = nil
+		if err := locker.Release(context.Background(), testRequest("first", "deploy"), "first", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	urgent := testRequest("urgent", "deploy")
+	urgent.Priority = 10
+	if _, err := acquireLocks(context.Background(), locker, urgent, time.Minute, clock); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, locker, "deploy"); len(got) != 1 || got[0] != "urgent" {
+		t.Errorf("expected deploy to be held by urgent, got %v", got)
+	}
+}
+
+func TestAcquireLocksTimeout(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	mustAcquire(t, locker, testRequest("first", "deploy"), clock)
+
+	start := clock.Now()
+	_, err := acquireLocks(context.Background(), locker, testRequest("second", "deploy"), time.Second, clock)
+	if err != errLockTimeout {
+		t.Fatalf("expected %v, got %v", errLockTimeout, err)
+	}
+	if waited := clock.Now().Sub(start); waited != time.Second {
+		t.Errorf("expected to wait for exactly the timeout, waited %v", waited)
+	}
+
+	// Giving up also gives up the place in line
+	states, err := locker.Inspect(context.Background(), []string{"deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := states["deploy"].Queue["second"]; ok {
+		t.Error("second kept its place in line after it timed out")
+	}
+}
+
+func TestAcquireLocksCancelWhileWaiting(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	mustAcquire(t, locker, testRequest("first", "deploy"), clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clock.onWait = func() {
+		clock.blocked = true
+		cancel()
+	}
+	_, err := acquireLocks(ctx, locker, testRequest("second", "deploy"), time.Minute, clock)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	states, err := locker.Inspect(context.Background(), []string{"deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := states["deploy"].Queue["second"]; ok {
+		t.Error("second kept its place in line after it was cancelled")
+	}
+}
+
+func TestAcquireLocksCancelReleases(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+
+	// An attempt that was cancelled might still have acquired the locks, so they're
+	// released again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := acquireLocks(ctx, locker, testRequest("first", "deploy", "release"), time.Minute, clock)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	for _, name := range []string{"deploy", "release"} {
+		if got := holders(t, locker, name); len(got) != 0 {
+			t.Errorf("expected %s to be released, held by %v", name, got)
+		}
+	}
+}
+
+func TestAcquireLocksHierarchyFIFO(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	hierarchical := func(token, name string) *lockRequest {
+		request := testRequest(token, name)
+		request.Hierarchical = true
+		return request
+	}
+	mustAcquire(t, locker, hierarchical("api", "prod/api"), clock)
+
+	// A freeze of prod is waiting for the deploy of api below it. A deploy of web
+	// that arrives later must not get in ahead of the freeze, even though nobody
+	// holds prod or prod/web yet.
+	web := hierarchical("web", "prod/web")
+	clock.onWait = func() {
+		clock.onWait = nil
+		attempt, err := locker.Acquire(context.Background(), web, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Acquired {
+			t.Fatal("web acquired its lock ahead of the freeze of prod, which was waiting longer")
+		}
+		if err := locker.Release(context.Background(), hierarchical("api", "prod/api"), "api", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := acquireLocks(context.Background(), locker, hierarchical("freeze", "prod"), time.Minute, clock); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, locker, "prod"); len(got) != 1 || got[0] != "freeze" {
+		t.Errorf("expected prod to be held by freeze, got %v", got)
+	}
+
+	// Once the freeze is released, web is next
+	if err := locker.Release(context.Background(), hierarchical("freeze", "prod"), "freeze", true); err != nil {
+		t.Fatal(err)
+	}
+	attempt, err := locker.Acquire(context.Background(), web, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attempt.Acquired {
+		t.Errorf("web didn't acquire its lock after the freeze was released: %v", attempt.Waiting)
+	}
+}
+
+func TestAcquireLocksReentrant(t *testing.T) {
+	locker := newMemoryLocker()
+	clock := newFakeClock()
+	first := testRequest("first", "deploy")
+	first.Scope = "run-1"
+	mustAcquire(t, locker, first, clock)
+
+	// Second is in the same scope, so it enters the lock that first holds instead of
+	// waiting for it, and the lock is only released once both of them let go
+	second := testRequest("second", "deploy")
+	second.Scope = "run-1"
+	second.Wait = false
+	attempt, err := acquireLocks(context.Background(), locker, second, time.Minute, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.Owner != "first" {
+		t.Fatalf("expected second to re-enter the hold of first, got owner %s", attempt.Owner)
+	}
+	states, err := locker.Inspect(context.Background(), []string{"deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holds := states["deploy"].Holders["first"].Holds; holds != 2 {
+		t.Errorf("expected 2 holds, got %d", holds)
+	}
+
+	other := testRequest("other", "deploy")
+	other.Wait = false
+	if _, err := acquireLocks(context.Background(), locker, other, time.Minute, clock); err != errLockHeld {
+		t.Fatalf("expected an owner outside of the scope to get %v, got %v", errLockHeld, err)
+	}
+
+	if err := locker.Release(context.Background(), second, attempt.Owner, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, locker, "deploy"); len(got) != 1 || got[0] != "first" {
+		t.Fatalf("expected deploy to still be held by first after the first release, got %v", got)
+	}
+	if err := locker.Release(context.Background(), first, "first", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, locker, "deploy"); len(got) != 0 {
+		t.Fatalf("expected deploy to be released after the second release, held by %v", got)
+	}
+	mustAcquire(t, locker, other, clock)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// BackoffFixed waits the minimum interval between every attempt
+	BackoffFixed = "fixed"
+
+	// BackoffExponential multiplies the interval after every attempt, waiting a random
+	// time between half of the interval and the interval itself, but never less than
+	// the minimum interval
+	BackoffExponential = "exponential"
+
+	// BackoffDecorrelatedJitter waits a random time between the minimum interval and
+	// the previous wait times the multiplier
+	BackoffDecorrelatedJitter = "decorrelated-jitter"
+)
+
+// clock tells the time and waits for it to pass, so that the acquisition loop can be
+// driven by something other than the wall clock
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// wallClock is the clock of the system
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// backoff decides how long to wait before attempting to acquire a lock again. Random
+// wait times keep waiters from all trying again at the same moment.
+type backoff struct {
+	Strategy   string
+	Min        time.Duration
+	Max        time.Duration
+	Multiplier float64
+
+	random  *rand.Rand
+	attempt int
+	last    time.Duration
+}
+
+// newRandom returns a source of randomness of its own, seeded from the time
+func newRandom() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// newBackoff returns a backoff that draws its random waits from random, so that the
+// waits can be repeated by seeding it the same way
+func newBackoff(strategy string, min, max time.Duration, multiplier float64, random *rand.Rand) *backoff {
+	return &backoff{
+		Strategy:   strategy,
+		Min:        min,
+		Max:        max,
+		Multiplier: multiplier,
+		random:     random,
+	}
+}
+
+// validate checks that the backoff makes sense. Waiting longer than TicketLease between
+// attempts would give up our place in line every time.
+func (b *backoff) validate() error {
+	switch b.Strategy {
+	case BackoffFixed, BackoffExponential, BackoffDecorrelatedJitter:
+	default:
+		return fmt.Errorf("unknown %s %q, expected %q, %q or %q", LockBackoffVar, b.Strategy, BackoffFixed, BackoffExponential, BackoffDecorrelatedJitter)
+	}
+	if b.Min <= 0 {
+		return fmt.Errorf("%s must be positive, got %v", LockBackoffMinVar, b.Min)
+	}
+	if b.Max < b.Min {
+		return fmt.Errorf("%s must be at least %s, got %v", LockBackoffMaxVar, LockBackoffMinVar, b.Max)
+	}
+	if b.Max >= TicketLease {
+		return fmt.Errorf("%s must be shorter than %v, or waiters lose their place in line, got %v", LockBackoffMaxVar, TicketLease, b.Max)
+	}
+	if b.Multiplier < 1 {
+		return fmt.Errorf("%s must be at least 1, got %v", LockBackoffMultiplierVar, b.Multiplier)
+	}
+	return nil
+}
+
+// next returns how long to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	var wait time.Duration
+	switch b.Strategy {
+	case BackoffFixed:
+		wait = b.Min
+	case BackoffExponential:
+		interval := float64(b.Min) * math.Pow(b.Multiplier, float64(b.attempt))
+		interval = math.Min(interval, float64(b.Max))
+		wait = time.Duration(interval/2 + b.random.Float64()*interval/2)
+	case BackoffDecorrelatedJitter:
+		upper := float64(b.Min)
+		if b.last > 0 {
+			upper = float64(b.last) * b.Multiplier
+		}
+		wait = b.Min + time.Duration(b.random.Float64()*(upper-float64(b.Min)))
+	}
+	if wait < b.Min {
+		wait = b.Min
+	}
+	if wait > b.Max {
+		wait = b.Max
+	}
+	b.attempt++
+	b.last = wait
+	return wait
+}
+
+// reset starts over at the minimum interval, for when the lock changed hands and might
+// be available again soon
+func (b *backoff) reset() {
+	b.attempt = 0
+	b.last = 0
+}
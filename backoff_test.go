@@ -0,0 +1,23 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoffWaits(t *testing.T) {
+	for _, strategy := range []string{BackoffFixed, BackoffExponential, BackoffDecorrelatedJitter} {
+		first := newBackoff(strategy, 500*time.Millisecond, 10*time.Second, 2, rand.New(rand.NewSource(1)))
+		second := newBackoff(strategy, 500*time.Millisecond, 10*time.Second, 2, rand.New(rand.NewSource(1)))
+		for i := 0; i < 20; i++ {
+			wait := first.next()
+			if wait < first.Min || wait > first.Max {
+				t.Errorf("%s: wait %d of %v is outside of %v to %v", strategy, i, wait, first.Min, first.Max)
+			}
+			if other := second.next(); other != wait {
+				t.Errorf("%s: wait %d differs between the same seeds, %v and %v", strategy, i, wait, other)
+			}
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// SourceFlag settings were passed as a command line flag
+	SourceFlag = "flag"
+
+	// SourceEnv settings were read from an INPUT_ environment variable, which is how
+	// GitHub Actions passes the inputs of the action
+	SourceEnv = "env"
+
+	// SourceConfig settings were read from a config file
+	SourceConfig = "config file"
+
+	// SourceDefault settings weren't set anywhere
+	SourceDefault = "default"
+)
+
+const (
+	// ConfigFileVar is the key for the setting to control which config file to read settings and profiles from
+	ConfigFileVar = "config"
+
+	// ProfileVar is the key for the setting to control which profile of the config file to use
+	ProfileVar = "profile"
+
+	// DefaultConfigFile is the config file that's read when it exists and no other one is given
+	DefaultConfigFile = ".github/locks.yml"
+
+	// ProfilesKey is the key of the config file under which the profiles are declared
+	ProfilesKey = "profiles"
+)
+
+// setting is a setting that can be set by a flag, an INPUT_ environment variable or a
+// config file, in that order, and otherwise has a default
+type setting struct {
+	Key     string
+	Default interface{}
+	Usage   string
+}
+
+// settings are all of the settings of the commands that acquire and release locks
+var settings = []setting{
+	{LockBackendVar, DefaultLockBackend, "Backend to keep the lock in"},
+	{LockTableVar, DefaultLockTable, "DynamoDB or Postgres table to write the lock in"},
+	{LockKeyNameVar, DefaultLockKeyName, "Name of the column where we write locks"},
+	{LockBucketVar, "", "S3 bucket to write the lock in"},
+	{LockPrefixVar, DefaultLockPrefix, "Prefix of the keys that locks are written at, for the s3, redis and etcd backends"},
+	{LockEndpointVar, "", "Endpoint of the backend, like http://localhost:9000 for MinIO, redis://localhost:6379 for Redis, http://localhost:2379 for etcd, or a connection string for Postgres"},
+	{LockNameVar, DefaultLockName, "Name of the lock, or a comma separated list of locks to acquire all at once"},
+	{LockTokenVar, "", "Owner token of the lock, generated by lock and read from the action state by unlock when empty"},
+	{LockTimeoutVar, DefaultLockTimeout, "How long to wait to acquire a lock, in minutes. Deprecated, use acquire-timeout instead"},
+	{LockAcquireTimeoutVar, DefaultLockAcquireTimeout, "How long to wait to acquire a lock, like 90s or 1h30m"},
+	{LockWaitVar, true, "Wait for the lock while it's held, or give up right away and exit with code 3"},
+	{LockBackoffVar, DefaultLockBackoff, "How the wait between attempts grows, either fixed, exponential or decorrelated-jitter"},
+	{LockBackoffMinVar, DefaultLockBackoffMin, "Shortest wait between attempts to acquire the lock"},
+	{LockBackoffMaxVar, DefaultLockBackoffMax, "Longest wait between attempts to acquire the lock"},
+	{LockBackoffMultiplierVar, DefaultLockBackoffMultiplier, "Factor the wait between attempts grows by"},
+	{LockRetryBudgetVar, DefaultLockRetryBudget, "How long to keep retrying while DynamoDB is throttling or failing, before giving up"},
+	{LockLeaseVar, time.Duration(DefaultLockLease), "How long the lock is held without being renewed before it expires, or 0 to never expire"},
+	{LockMaxHoldVar, time.Duration(DefaultLockMaxHold), "Longest the lock is held before waiting jobs can break it, like 1h30m, or 0 for no maximum"},
+	{LockHeartbeatVar, false, "Keep renewing the lease from a detached process after the lock is acquired"},
+	{LockHeartbeatIntervalVar, time.Duration(0), "How often the lease is renewed, defaults to a third of the lease"},
+	{LockHeartbeatOnLostVar, OnLostWarn, "What to do when the lease is lost, either warn or kill the process doing the work"},
+	{LockHeartbeatPIDVar, 0, "Process doing the work, which is killed when the lease is lost, and after which the lock is released once it exits"},
+	{LockPermitsVar, DefaultLockPermits, "How many owners can hold the lock at once"},
+	{LockModeVar, DefaultLockMode, "Whether to hold the lock shared with other shared holders, or exclusive"},
+	{LockPriorityVar, DefaultLockPriority, "Priority while waiting for the lock, higher priorities acquire the lock first"},
+	{LockReentrantVar, "", "Let owners in the same run, run-attempt or job re-enter the lock instead of waiting for it"},
+	{LockHierarchicalVar, false, "Treat lock names as paths, which conflict with the holders of the locks above and below them"},
+	{LockAdvisoryVar, false, "Hold Postgres session advisory locks while the command runs, instead of rows of the lock table"},
+}
+
+func init() {
+	for _, s := range settings {
+		viper.SetDefault(s.Key, s.Default)
+	}
+}
+
+// readConfigFile reads the settings at the top of the config file, if there is one,
+// and the settings of the selected profile over them
+func readConfigFile() error {
+	path := viper.GetString(ConfigFileVar)
+	profile := viper.GetString(ProfileVar)
+	if path == "" {
+		path = DefaultConfigFile
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if profile != "" {
+				return fmt.Errorf("profile %q was selected, but there is no config file at %s", profile, path)
+			}
+			return nil
+		}
+	}
+
+	// The file is read on its own first, so that its keys can be checked without the
+	// defaults and flags that are already in viper
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	values := file.AllSettings()
+	profiles := file.GetStringMap(ProfilesKey)
+	delete(values, ProfilesKey)
+	if err := checkSettingKeys(path, values); err != nil {
+		return err
+	}
+	log.Printf("Reading settings from %s", path)
+	if err := viper.MergeConfigMap(values); err != nil {
+		return err
+	}
+
+	if profile == "" {
+		return nil
+	}
+	// Viper lowercases every key it reads, profile names included
+	values, ok := profiles[strings.ToLower(profile)].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("there is no profile %q in %s", profile, path)
+	}
+	if err := checkSettingKeys(fmt.Sprintf("profile %q of %s", profile, path), values); err != nil {
+		return err
+	}
+	log.Printf("Using profile %s", profile)
+	return viper.MergeConfigMap(values)
+}
+
+// checkSettingKeys makes sure that every key in values is a setting, to catch typos in
+// config files
+func checkSettingKeys(where string, values map[string]interface{}) error {
+	for key := range values {
+		known := false
+		for _, s := range settings {
+			if s.Key == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown setting %q in %s", key, where)
+		}
+	}
+	return nil
+}
+
+// addSettingFlags defines a flag for each of the settings with the given keys
+func addSettingFlags(cmd *cobra.Command, keys ...string) {
+	for _, key := range keys {
+		for _, s := range settings {
+			if s.Key != key {
+				continue
+			}
+			switch value := s.Default.(type) {
+			case string:
+				cmd.PersistentFlags().String(s.Key, value, s.Usage)
+			case int:
+				cmd.PersistentFlags().Int(s.Key, value, s.Usage)
+			case bool:
+				cmd.PersistentFlags().Bool(s.Key, value, s.Usage)
+			case float64:
+				cmd.PersistentFlags().Float64(s.Key, value, s.Usage)
+			case time.Duration:
+				cmd.PersistentFlags().Duration(s.Key, value, s.Usage)
+			default:
+				panic(fmt.Sprintf("setting %s has a default of unsupported type %T", s.Key, value))
+			}
+		}
+	}
+}
+
+// settingEnv is the environment variable a setting is read from
+func settingEnv(key string) string {
+	return "INPUT_" + strings.ToUpper(key)
+}
+
+// settingSource returns where the value of a setting of cmd came from
+func settingSource(cmd *cobra.Command, key string) string {
+	if flag := cmd.Flags().Lookup(key); flag != nil && flag.Changed {
+		return SourceFlag
+	}
+	if value, ok := os.LookupEnv(settingEnv(key)); ok && value != "" {
+		return SourceEnv
+	}
+	if viper.InConfig(key) {
+		return SourceConfig
+	}
+	return SourceDefault
+}
+
+// lockConfig are the settings of the commands that acquire and release locks, all
+// resolved from the same sources in the same order
+type lockConfig struct {
+	Backend           string
+	Table             string
+	Key               string
+	Bucket            string
+	Prefix            string
+	Endpoint          string
+	Name              string
+	Names             []string
+	Token             string
+	AcquireTimeout    time.Duration
+	Wait              bool
+	Backoff           string
+	BackoffMin        time.Duration
+	BackoffMax        time.Duration
+	BackoffMultiplier float64
+	RetryBudget       time.Duration
+	Lease             time.Duration
+	MaxHold           time.Duration
+	Heartbeat         bool
+	HeartbeatInterval time.Duration
+	HeartbeatOnLost   string
+	HeartbeatPID      int
+	Permits           int
+	Mode              string
+	Priority          int
+	Reentrant         string
+	Scope             string
+	Hierarchical      bool
+	Advisory          bool
+}
+
+// settingParser parses the raw values of settings, which come from flags, INPUT_
+// environment variables and config files alike, and keeps the first error
+type settingParser struct {
+	err error
+}
+
+// fail keeps the error about a setting, unless there is one already
+func (p *settingParser) fail(key, value, expected string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q, expected %s", key, value, expected)
+	}
+}
+
+func (p *settingParser) string(key string) string {
+	return viper.GetString(key)
+}
+
+// duration parses a duration with a unit, so that a bare number like 45 isn't taken
+// to mean 45 nanoseconds
+func (p *settingParser) duration(key string) time.Duration {
+	value := strings.TrimSpace(viper.GetString(key))
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		p.fail(key, value, "a duration with a unit like 90s or 1h30m")
+	}
+	return d
+}
+
+func (p *settingParser) bool(key string) bool {
+	value := strings.TrimSpace(viper.GetString(key))
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(key, value, "true or false")
+	}
+	return b
+}
+
+func (p *settingParser) int(key string) int {
+	value := strings.TrimSpace(viper.GetString(key))
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		p.fail(key, value, "a whole number")
+	}
+	return i
+}
+
+func (p *settingParser) float(key string) float64 {
+	value := strings.TrimSpace(viper.GetString(key))
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.fail(key, value, "a number")
+	}
+	return f
+}
+
+// loadConfig resolves the settings of cmd, whose flags have to be bound to viper, and
+// validates them for command, one of the Command constants
+func loadConfig(cmd *cobra.Command, command string) (*lockConfig, error) {
+	p := &settingParser{}
+	c := &lockConfig{
+		Backend:           p.string(LockBackendVar),
+		Table:             p.string(LockTableVar),
+		Key:               p.string(LockKeyNameVar),
+		Bucket:            p.string(LockBucketVar),
+		Prefix:            p.string(LockPrefixVar),
+		Endpoint:          p.string(LockEndpointVar),
+		Name:              p.string(LockNameVar),
+		Token:             p.string(LockTokenVar),
+		AcquireTimeout:    p.duration(LockAcquireTimeoutVar),
+		Wait:              p.bool(LockWaitVar),
+		Backoff:           p.string(LockBackoffVar),
+		BackoffMin:        p.duration(LockBackoffMinVar),
+		BackoffMax:        p.duration(LockBackoffMaxVar),
+		BackoffMultiplier: p.float(LockBackoffMultiplierVar),
+		RetryBudget:       p.duration(LockRetryBudgetVar),
+		Lease:             p.duration(LockLeaseVar),
+		MaxHold:           p.duration(LockMaxHoldVar),
+		Heartbeat:         p.bool(LockHeartbeatVar),
+		HeartbeatInterval: p.duration(LockHeartbeatIntervalVar),
+		HeartbeatOnLost:   p.string(LockHeartbeatOnLostVar),
+		HeartbeatPID:      p.int(LockHeartbeatPIDVar),
+		Permits:           p.int(LockPermitsVar),
+		Mode:              p.string(LockModeVar),
+		Priority:          p.int(LockPriorityVar),
+		Reentrant:         p.string(LockReentrantVar),
+		Hierarchical:      p.bool(LockHierarchicalVar),
+		Advisory:          p.bool(LockAdvisoryVar),
+	}
+	if settingSource(cmd, LockTimeoutVar) != SourceDefault && settingSource(cmd, LockAcquireTimeoutVar) == SourceDefault {
+		log.Printf("%s is deprecated, use %s instead", LockTimeoutVar, LockAcquireTimeoutVar)
+		c.AcquireTimeout = time.Duration(p.int(LockTimeoutVar)) * time.Minute
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if c.Advisory && command != CommandRun {
+		// The locks are released as soon as the process that holds them exits
+		return nil, fmt.Errorf("%s locks only last as long as the process that holds them, so only run supports them", LockAdvisoryVar)
+	}
+	return c, c.validate()
+}
+
+// validate checks the settings, and fills in the ones that are derived from others
+func (c *lockConfig) validate() error {
+	if _, ok := backends[c.Backend]; !ok {
+		return fmt.Errorf("unknown %s %q, expected one of %s", LockBackendVar, c.Backend, strings.Join(backendNames(), ", "))
+	}
+	if c.Advisory && c.Backend != BackendPostgres {
+		return fmt.Errorf("%s locks need the %s backend, got %s", LockAdvisoryVar, BackendPostgres, c.Backend)
+	}
+	name, err := expandLockNames(c.Name)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", LockNameVar, err)
+	}
+	if name != c.Name {
+		log.Printf("Expanded lock name %s to %s", c.Name, name)
+		c.Name = name
+	}
+	names, err := lockNames(c.Name)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", LockNameVar, err)
+	}
+	c.Names = names
+	if c.Reentrant != "" {
+		c.Scope, err = reentrancyScope(c.Reentrant)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", LockReentrantVar, err)
+		}
+	}
+	if c.AcquireTimeout < 0 {
+		return fmt.Errorf("%s must not be negative, got %v", LockAcquireTimeoutVar, c.AcquireTimeout)
+	}
+	if c.Lease < 0 || (c.Lease > 0 && c.Lease < MinLockLease) {
+		return fmt.Errorf("%s must be at least %v, or 0 to never expire, got %v", LockLeaseVar, MinLockLease, c.Lease)
+	}
+	if c.Heartbeat && c.Lease == 0 {
+		return fmt.Errorf("%s needs a %s to renew", LockHeartbeatVar, LockLeaseVar)
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("%s must not be negative, got %v", LockHeartbeatIntervalVar, c.HeartbeatInterval)
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = c.Lease / 3
+		if c.Advisory && c.Lease == 0 {
+			// Advisory locks don't have a lease, but are still checked on
+			c.HeartbeatInterval = DefaultAdvisoryInterval
+		}
+	}
+	if c.Lease > 0 && c.HeartbeatInterval >= c.Lease {
+		return fmt.Errorf("%s must be shorter than the %s of %v, got %v", LockHeartbeatIntervalVar, LockLeaseVar, c.Lease, c.HeartbeatInterval)
+	}
+	if c.HeartbeatOnLost != OnLostWarn && c.HeartbeatOnLost != OnLostKill {
+		return fmt.Errorf("unknown %s action %q, expected %q or %q", LockHeartbeatOnLostVar, c.HeartbeatOnLost, OnLostWarn, OnLostKill)
+	}
+	if c.HeartbeatPID < 0 {
+		return fmt.Errorf("%s must not be negative, got %d", LockHeartbeatPIDVar, c.HeartbeatPID)
+	}
+	if c.Heartbeat && c.HeartbeatOnLost == OnLostKill && c.HeartbeatPID == 0 {
+		// The process that ran lock is usually gone long before the work is done
+		return fmt.Errorf("%s %s needs the %s of the process doing the work", LockHeartbeatOnLostVar, OnLostKill, LockHeartbeatPIDVar)
+	}
+	return c.request().validate()
+}
+
+// request is the request to acquire the locks described by the settings
+func (c *lockConfig) request() *lockRequest {
+	return &lockRequest{
+		Names:        c.Names,
+		Token:        c.Token,
+		Mode:         c.Mode,
+		Permits:      c.Permits,
+		Priority:     c.Priority,
+		Lease:        c.Lease,
+		MaxHold:      c.MaxHold,
+		Scope:        c.Scope,
+		Hierarchical: c.Hierarchical,
+		Wait:         c.Wait,
+		Backoff:      newBackoff(c.Backoff, c.BackoffMin, c.BackoffMax, c.BackoffMultiplier, newRandom()),
+		RetryBudget:  c.RetryBudget,
+	}
+}
+
+// logSources logs the value of every setting that cmd has a flag for, along with where
+// the value came from
+func logSources(cmd *cobra.Command) {
+	for _, s := range settings {
+		if cmd.Flags().Lookup(s.Key) == nil {
+			continue
+		}
+		source := settingSource(cmd, s.Key)
+		switch source {
+		case SourceFlag:
+			source += " --" + s.Key
+		case SourceEnv:
+			source += " " + settingEnv(s.Key)
+		}
+		value := viper.GetString(s.Key)
+		if s.Key == LockEndpointVar {
+			value = redactEndpoint(value)
+		}
+		log.Printf("%s: %v (%s)", s.Key, value, source)
+	}
+}
+
+// passwordParam is a password in a Postgres connection string, either as a keyword of
+// its own or as a parameter of a URL, quoted or not
+var passwordParam = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]*)`)
+
+// redactEndpoint hides the passwords in an endpoint, so that it can be logged
+func redactEndpoint(endpoint string) string {
+	endpoint = passwordParam.ReplaceAllString(endpoint, "${1}xxxxx")
+	u, err := url.Parse(endpoint)
+	if err != nil || u.User == nil {
+		return endpoint
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
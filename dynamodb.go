@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// MaxLockNames is the most locks that can be acquired at once, since they're all
+// written in a single DynamoDB transaction of at most 100 items, along with the
+// fence counter of each of them
+const MaxLockNames = 50
+
+// BackendDynamoDB keeps every lock in an item of a DynamoDB table
+const BackendDynamoDB = "dynamodb"
+
+func init() {
+	registerBackend(BackendDynamoDB, func(config *lockConfig) (Locker, error) {
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		cfg := aws.NewConfig()
+		if config.Endpoint != "" {
+			cfg = cfg.WithEndpoint(config.Endpoint)
+		}
+		return &storeLocker{clock: wallClock{}, store: &dynamoStore{
+			svc:   dynamodb.New(sess, cfg),
+			table: config.Table,
+			key:   config.Key,
+		}}, nil
+	})
+}
+
+// dynamoStore keeps the state of every lock in an item of table, keyed by the lock
+// name in the key attribute, and guards every write with the Version attribute
+type dynamoStore struct {
+	svc   *dynamodb.DynamoDB
+	table string
+	key   string
+}
+
+// errVersionConflict is returned by saveLocks when a lock was changed by someone else
+// since it was loaded, and by storeLocker once that kept happening, see retryConflicts
+var errVersionConflict = errors.New("lock was changed concurrently")
+
+// legacyItem is an item that was written by a version from before lock states had a
+// Version: either just the key, by the first version, or the Owner, ExpiresAt and
+// Fence of a single holder. Those versions don't understand items in the current
+// format, so an item of theirs is never written while they might still hold it.
+type legacyItem struct {
+	Owner     string
+	ExpiresAt int64
+	Fence     int64
+}
+
+// legacyLockError is returned when a lock is held in an item that was written by an
+// older version
+type legacyLockError struct {
+	Name  string
+	Owner string
+}
+
+func (e *legacyLockError) Error() string {
+	return fmt.Sprintf("lock %s is held by %s in an item written by an older version of this action, which can't share locks with this one. "+
+		"Wait for it to be released, and move every workflow that uses the table to the same version", e.Name, e.Owner)
+}
+
+// fenceCounter is the item that the fencing token of a lock is counted in. It's kept
+// apart from the item of the lock, which TTL deletes once its leases ran out, and
+// never expires itself, so that fencing tokens keep counting up.
+type fenceCounter struct {
+	Fence int64
+}
+
+// lockKey is the key of the item that a lock is stored in
+func lockKey(key, name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		key: {
+			S: aws.String(name),
+		},
+	}
+}
+
+// fenceKey is the key of the fenceCounter item of a lock. Lock names can't contain
+// commas, so it never is the key of a lock itself.
+func fenceKey(key, name string) map[string]*dynamodb.AttributeValue {
+	return lockKey(key, name+",fence")
+}
+
+// getItems reads the items with keys, all at the same point in time, returning an
+// empty item for each key that doesn't exist
+func (s *dynamoStore) getItems(ctx context.Context, keys []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	if len(keys) == 1 {
+		output, err := s.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.table),
+			ConsistentRead: aws.Bool(true),
+			Key:            keys[0],
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]*dynamodb.AttributeValue{output.Item}, nil
+	}
+
+	input := &dynamodb.TransactGetItemsInput{}
+	for _, key := range keys {
+		input.TransactItems = append(input.TransactItems, &dynamodb.TransactGetItem{
+			Get: &dynamodb.Get{
+				TableName: aws.String(s.table),
+				Key:       key,
+			},
+		})
+	}
+	output, err := s.svc.TransactGetItemsWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	for _, response := range output.Responses {
+		items = append(items, response.Item)
+	}
+	return items, nil
+}
+
+func (s *dynamoStore) loadLocks(ctx context.Context, names []string) (map[string]*lockState, error) {
+	var keys []map[string]*dynamodb.AttributeValue
+	for _, name := range names {
+		keys = append(keys, lockKey(s.key, name))
+	}
+	items, err := s.getItems(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]*lockState{}
+	var missing []string
+	for i, name := range names {
+		if len(items[i]) > 0 && items[i][VersionAttr] == nil {
+			// The single holder of an older version is taken as an exclusive holder
+			legacy := &legacyItem{}
+			if err := dynamodbattribute.UnmarshalMap(items[i], legacy); err != nil {
+				return nil, err
+			}
+			owner := legacy.Owner
+			if owner == "" {
+				owner = LegacyOwner
+			}
+			states[name] = &lockState{
+				Holders: map[string]*lockHolder{
+					owner: {Mode: ModeExclusive, ExpiresAt: legacy.ExpiresAt, Fence: legacy.Fence},
+				},
+				Fence:       legacy.Fence,
+				loadedFence: legacy.Fence,
+				legacy:      legacy,
+			}
+			continue
+		}
+		if len(items[i]) == 0 {
+			missing = append(missing, name)
+		}
+
+		state := &lockState{}
+		if err := dynamodbattribute.UnmarshalMap(items[i], state); err != nil {
+			return nil, err
+		}
+		state.loadedFence = state.Fence
+		states[name] = state
+	}
+	if len(missing) == 0 {
+		return states, nil
+	}
+
+	// A lock without an item was either never acquired, or its item was deleted by
+	// TTL, and its fencing token carries on from its counter
+	keys = nil
+	for _, name := range missing {
+		keys = append(keys, fenceKey(s.key, name))
+	}
+	counters, err := s.getItems(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range missing {
+		counter := &fenceCounter{}
+		if err := dynamodbattribute.UnmarshalMap(counters[i], counter); err != nil {
+			return nil, err
+		}
+		states[name].Fence = counter.Fence
+		states[name].loadedFence = counter.Fence
+	}
+	return states, nil
+}
+
+// lockPut writes the state of a lock, as long as nobody else has written it since
+// it was loaded
+func lockPut(table, key, name string, state *lockState) (*dynamodb.Put, error) {
+	put := &dynamodb.Put{
+		TableName:           aws.String(table),
+		ConditionExpression: aws.String("attribute_not_exists(#version)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#version": aws.String(VersionAttr),
+		},
+	}
+	if state.legacy != nil {
+		// The lease of the older version ran out, and the item is only overwritten as
+		// long as it wasn't renewed in the meantime
+		put.ConditionExpression = aws.String("attribute_not_exists(#version) AND #owner = :owner AND #expires = :expires")
+		put.ExpressionAttributeNames["#owner"] = aws.String(LegacyOwnerAttr)
+		put.ExpressionAttributeNames["#expires"] = aws.String(LegacyExpiresAtAttr)
+		put.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":owner": {
+				S: aws.String(state.legacy.Owner),
+			},
+			":expires": {
+				N: aws.String(strconv.FormatInt(state.legacy.ExpiresAt, 10)),
+			},
+		}
+	} else if state.Version != 0 {
+		put.ConditionExpression = aws.String("#version = :version")
+		put.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":version": {
+				N: aws.String(strconv.FormatInt(state.Version, 10)),
+			},
+		}
+	}
+
+	next := *state
+	next.Version++
+	next.ExpiresAt = next.expiry()
+	item, err := dynamodbattribute.MarshalMap(&next)
+	if err != nil {
+		return nil, err
+	}
+	for attr, value := range lockKey(key, name) {
+		item[attr] = value
+	}
+	put.Item = item
+	return put, nil
+}
+
+// fencePut writes the fence counter of a lock, as long as that doesn't make it go
+// backwards
+func fencePut(table, key, name string, fence int64) *dynamodb.Put {
+	item := fenceKey(key, name)
+	item[FenceAttr] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(fence, 10)),
+	}
+	return &dynamodb.Put{
+		TableName:           aws.String(table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#fence) OR #fence < :fence"),
+		ExpressionAttributeNames: map[string]*string{
+			"#fence": aws.String(FenceAttr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":fence": item[FenceAttr],
+		},
+	}
+}
+
+// saveLocks writes the state of each of the locks, all or nothing, as long as nobody
+// else has written any of them since they were loaded. The fence counter of every
+// lock that was acquired is written along with it.
+func (s *dynamoStore) saveLocks(ctx context.Context, states map[string]*lockState) error {
+	svc, table, key := s.svc, s.table, s.key
+	var puts []*dynamodb.Put
+	for name, state := range states {
+		put, err := lockPut(table, key, name, state)
+		if err != nil {
+			return err
+		}
+		puts = append(puts, put)
+		if state.Fence > state.loadedFence {
+			puts = append(puts, fencePut(table, key, name, state.Fence))
+		}
+	}
+
+	if len(puts) == 1 {
+		_, err := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:                 puts[0].TableName,
+			Item:                      puts[0].Item,
+			ConditionExpression:       puts[0].ConditionExpression,
+			ExpressionAttributeNames:  puts[0].ExpressionAttributeNames,
+			ExpressionAttributeValues: puts[0].ExpressionAttributeValues,
+		})
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case dynamodb.ErrCodeConditionalCheckFailedException, dynamodb.ErrCodeTransactionConflictException:
+				return errVersionConflict
+			}
+		}
+		return err
+	}
+
+	input := &dynamodb.TransactWriteItemsInput{}
+	for _, put := range puts {
+		input.TransactItems = append(input.TransactItems, &dynamodb.TransactWriteItem{Put: put})
+	}
+	_, err := svc.TransactWriteItemsWithContext(ctx, input)
+	if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, reason := range canceled.CancellationReasons {
+			switch aws.StringValue(reason.Code) {
+			case "ConditionalCheckFailed", "TransactionConflict":
+				return errVersionConflict
+			}
+		}
+	}
+	return err
+}
+
+func (s *dynamoStore) updateLocks(ctx context.Context, names []string, change func(map[string]*lockState) error) error {
+	states, err := s.loadLocks(ctx, names)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, name := range names {
+		if states[name].legacy == nil {
+			continue
+		}
+		for owner, holder := range states[name].Holders {
+			if !holder.expired(now) {
+				return &legacyLockError{Name: name, Owner: owner}
+			}
+		}
+	}
+	if err := change(states); err != nil {
+		return err
+	}
+
+	return s.saveLocks(ctx, states)
+}
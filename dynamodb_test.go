@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// fakeDynamoDB serves the DynamoDB calls of dynamoStore from items in memory. It
+// doesn't check conditions, so it only works for a single writer at a time.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var output interface{}
+	var err error
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "GetItem":
+		input := &dynamodb.GetItemInput{}
+		err = json.NewDecoder(r.Body).Decode(input)
+		output = &dynamodb.GetItemOutput{Item: f.items[aws.StringValue(input.Key["LockID"].S)]}
+	case "TransactGetItems":
+		input := &dynamodb.TransactGetItemsInput{}
+		err = json.NewDecoder(r.Body).Decode(input)
+		result := &dynamodb.TransactGetItemsOutput{}
+		for _, item := range input.TransactItems {
+			result.Responses = append(result.Responses, &dynamodb.ItemResponse{Item: f.items[aws.StringValue(item.Get.Key["LockID"].S)]})
+		}
+		output = result
+	case "PutItem":
+		input := &dynamodb.PutItemInput{}
+		err = json.NewDecoder(r.Body).Decode(input)
+		f.items[aws.StringValue(input.Item["LockID"].S)] = input.Item
+		output = &dynamodb.PutItemOutput{}
+	case "TransactWriteItems":
+		input := &dynamodb.TransactWriteItemsInput{}
+		err = json.NewDecoder(r.Body).Decode(input)
+		for _, item := range input.TransactItems {
+			f.items[aws.StringValue(item.Put.Item["LockID"].S)] = item.Put.Item
+		}
+		output = &dynamodb.TransactWriteItemsOutput{}
+	default:
+		http.Error(w, "unexpected call "+r.Header.Get("X-Amz-Target"), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(output)
+}
+
+// newFakeDynamoLocker returns a Locker that keeps its locks in a fakeDynamoDB
+func newFakeDynamoLocker(t *testing.T) (Locker, *fakeDynamoDB) {
+	fake := &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &storeLocker{clock: wallClock{}, store: &dynamoStore{
+		svc:   dynamodb.New(sess),
+		table: "github-action-locks",
+		key:   "LockID",
+	}}, fake
+}
+
+func TestDynamoFencesSurviveTTL(t *testing.T) {
+	for _, names := range [][]string{{"deploy"}, {"network", "cluster"}} {
+		locker, fake := newFakeDynamoLocker(t)
+		for i, token := range []string{"first", "second", "third"} {
+			request := testRequest(token, names...)
+			request.Wait = false
+			attempt, err := acquireLocks(context.Background(), locker, request, time.Minute, wallClock{})
+			if err != nil {
+				t.Fatalf("%v: acquiring as %s: %v", names, token, err)
+			}
+			for j, fence := range attempt.Fences {
+				if fence != int64(i+1) {
+					t.Errorf("%v: expected %s to get fencing token %d for %s, got %d", names, token, i+1, names[j], fence)
+				}
+			}
+			if err := locker.Release(context.Background(), request, token, true); err != nil {
+				t.Fatal(err)
+			}
+
+			// TTL deletes the items of the locks, but not their counters
+			for _, name := range names {
+				delete(fake.items, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+)
+
+const (
+	// ErrorRetryable errors are throttling and failures on the side of AWS, which go
+	// away by trying again later
+	ErrorRetryable = "retryable"
+
+	// ErrorContention errors mean that somebody else holds the lock
+	ErrorContention = "contention"
+
+	// ErrorConfig errors are missing credentials or permissions, or settings that
+	// point at a table or bucket that doesn't exist, which won't go away without a fix
+	ErrorConfig = "auth/config"
+
+	// ErrorFatal errors are everything else
+	ErrorFatal = "fatal"
+)
+
+const (
+	// ExitFatal is the exit code for ErrorFatal errors, and for being cancelled
+	ExitFatal = 1
+
+	// ExitNotAcquired is the exit code for ErrorContention errors, when the lock was
+	// held until the acquire-timeout ran out
+	ExitNotAcquired = 3
+
+	// ExitConfig is the exit code for ErrorConfig errors
+	ExitConfig = 4
+
+	// ExitRetryable is the exit code for ErrorRetryable errors that kept happening
+	// until the retry-budget ran out
+	ExitRetryable = 5
+
+	// ExitLockHeld is the exit code for a lock that was held when we tried it once
+	// without waiting
+	ExitLockHeld = 6
+)
+
+const (
+	// RetryBackoffMin is the shortest wait before trying again after a retryable error
+	RetryBackoffMin = time.Second
+
+	// RetryBackoffMax is the longest wait before trying again after a retryable error
+	RetryBackoffMax = 20 * time.Second
+)
+
+// configCodes are the codes of AWS errors that are caused by credentials, permissions
+// or settings
+var configCodes = map[string]bool{
+	"AccessDeniedException":                   true,
+	"UnrecognizedClientException":             true,
+	"InvalidSignatureException":               true,
+	"ExpiredTokenException":                   true,
+	"MissingAuthenticationTokenException":     true,
+	"NoCredentialProviders":                   true,
+	"MissingRegion":                           true,
+	"MissingEndpoint":                         true,
+	dynamodb.ErrCodeResourceNotFoundException: true,
+	"ValidationException":                     true,
+	"AccessDenied":                            true,
+	"InvalidAccessKeyId":                      true,
+	"SignatureDoesNotMatch":                   true,
+	s3.ErrCodeNoSuchBucket:                    true,
+}
+
+// errorClass sorts err into ErrorRetryable, ErrorContention, ErrorConfig or ErrorFatal
+func errorClass(err error) string {
+	switch err {
+	case errLockHeld, errLockTimeout, errVersionConflict, errScopeConflict:
+		return ErrorContention
+	}
+
+	// The lock is held by an older version, which can't be waited for
+	if _, ok := err.(*legacyLockError); ok {
+		return ErrorConfig
+	}
+
+	if rerr, ok := err.(redis.Error); ok {
+		return redisErrorClass(rerr)
+	}
+	if perr, ok := err.(*pq.Error); ok {
+		return postgresErrorClass(perr)
+	}
+	if eerr, ok := err.(*etcdError); ok {
+		return etcdErrorClass(eerr)
+	}
+
+	// Connections that were refused, timed out or dropped, by any backend other than
+	// AWS, which wraps them in its own errors
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF || err == driver.ErrBadConn {
+		return ErrorRetryable
+	}
+
+	// A transaction that was cancelled because one of its items was throttled
+	if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) == "ThrottlingError" {
+				return ErrorRetryable
+			}
+		}
+		return ErrorFatal
+	}
+
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return ErrorFatal
+	}
+	if configCodes[aerr.Code()] {
+		return ErrorConfig
+	}
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return ErrorRetryable
+	}
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() >= 500 {
+		return ErrorRetryable
+	}
+	return ErrorFatal
+}
+
+// exitCode is the exit code for err, based on its class
+func exitCode(err error) int {
+	if err == errLockHeld {
+		return ExitLockHeld
+	}
+	switch errorClass(err) {
+	case ErrorContention:
+		return ExitNotAcquired
+	case ErrorConfig:
+		return ExitConfig
+	case ErrorRetryable:
+		return ExitRetryable
+	}
+	return ExitFatal
+}
+
+// retryTransient calls f until it succeeds or fails with an error that isn't
+// retryable. Retryable errors are tried again with their own backoff, until they kept
+// happening for longer than budget.
+func retryTransient(ctx context.Context, budget time.Duration, clock clock, f func() error) error {
+	backoff := newBackoff(BackoffDecorrelatedJitter, RetryBackoffMin, RetryBackoffMax, 3, newRandom())
+	deadline := clock.Now().Add(budget)
+	for {
+		err := f()
+		if err == nil || ctx.Err() != nil || errorClass(err) != ErrorRetryable {
+			return err
+		}
+
+		wait := backoff.next()
+		if !clock.Now().Add(wait).Before(deadline) {
+			log.Printf("Giving up after retryable errors for %v", budget)
+			return err
+		}
+		log.Printf("Retrying in %v after a retryable error: %+v", wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(wait):
+		}
+	}
+}
+
+// retryContended is retryTransient for writes that have to get through, like
+// releasing a lock, which also starts over when the locks kept changing while they
+// were written, for as long as budget lasts. Waiters write the locks on every attempt,
+// so a busy queue would otherwise keep the holder from letting go.
+func retryContended(ctx context.Context, budget time.Duration, clock clock, f func() error) error {
+	deadline := clock.Now().Add(budget)
+	for {
+		err := retryTransient(ctx, deadline.Sub(clock.Now()), clock, f)
+		if err != errVersionConflict || ctx.Err() != nil || !clock.Now().Before(deadline) {
+			return err
+		}
+		log.Print("Lock kept changing while writing it, trying again")
+	}
+}
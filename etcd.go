@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BackendEtcd keeps every lock in a key of an etcd cluster, attached to a lease
+	// that expires along with the lease of the lock
+	BackendEtcd = "etcd"
+
+	// DefaultEtcdEndpoint is the etcd server that's used when there's no endpoint
+	DefaultEtcdEndpoint = "http://localhost:2379"
+
+	// EtcdTimeout is how long to wait for the etcd server to answer a request, other
+	// than a watch
+	EtcdTimeout = 10 * time.Second
+)
+
+// gRPC status codes that are returned by etcd, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcAborted           = 10
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+func init() {
+	registerBackend(BackendEtcd, func(config *lockConfig) (Locker, error) {
+		// A key only has room for a single owner
+		if err := requireSingleOwner(config, BackendEtcd); err != nil {
+			return nil, err
+		}
+
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultEtcdEndpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			// The error of url.Parse repeats the endpoint, password and all
+			return nil, fmt.Errorf("invalid %s %s: %v", LockEndpointVar, redactEndpoint(endpoint), err.(*url.Error).Err)
+		}
+		locker := &etcdLocker{prefix: config.Prefix}
+		if u.User != nil {
+			locker.user = u.User
+			u.User = nil
+		}
+		locker.endpoint = strings.TrimSuffix(u.String(), "/")
+		return locker, nil
+	})
+}
+
+// etcdLocker keeps every lock in a key named after the lock under prefix, holding the
+// token of its owner. The key is only ever created while it doesn't exist, and is
+// attached to a lease of the owner unless the lock never expires, so that etcd deletes
+// it once the lease runs out. The revision the key was created at is its fencing
+// token, which only ever goes up since revisions are counted for the whole cluster.
+//
+// This talks to the JSON gateway of the etcd v3 API, since the gRPC client needs far
+// newer versions of Go and of everything else than we build with.
+type etcdLocker struct {
+	endpoint string
+	prefix   string
+	user     *url.Userinfo
+
+	// token authenticates requests when the endpoint has a user
+	token string
+	mutex sync.Mutex
+
+	// revision is the revision of the cluster at the last failed attempt to acquire
+	// the locks, which is where watches start from
+	revision int64
+}
+
+// etcdError is an error that was returned by the etcd server
+type etcdError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *etcdError) Error() string {
+	return fmt.Sprintf("etcd: %s (code %d)", e.Message, e.Code)
+}
+
+// etcdKeyValue is a key as it's returned by etcd, with the key and value encoded in
+// base64
+type etcdKeyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+	Lease          int64  `json:"lease,string"`
+}
+
+// etcdHeader is the header of every response, with the revision of the cluster
+// when the request was handled
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// etcdRangeResponse is the response to a range request, or a range in a transaction
+type etcdRangeResponse struct {
+	Header etcdHeader      `json:"header"`
+	Kvs    []*etcdKeyValue `json:"kvs"`
+}
+
+// etcdTxnResponse is the response to a transaction
+type etcdTxnResponse struct {
+	Header    etcdHeader `json:"header"`
+	Succeeded bool       `json:"succeeded"`
+	Responses []struct {
+		ResponseRange *etcdRangeResponse `json:"response_range"`
+		ResponsePut   *struct{}          `json:"response_put"`
+	} `json:"responses"`
+}
+
+// etcdLeaseResponse is the response to granting a lease, keeping it alive or asking
+// for its time to live. A TTL of 0 or less means that the lease has expired.
+type etcdLeaseResponse struct {
+	ID  int64 `json:"ID,string"`
+	TTL int64 `json:"TTL,string"`
+}
+
+// encode encodes a key or value in base64, the way etcd expects them in JSON
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// decode decodes a key or value that etcd encoded in base64
+func decode(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+// post sends a request to an endpoint of the etcd API and returns the response,
+// authenticating first when the endpoint has a user, and again once the token
+// expired
+func (l *etcdLocker) post(ctx context.Context, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	for retried := false; ; retried = true {
+		token, err := l.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, l.endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		etcdErr := &etcdError{}
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if json.Unmarshal(message, etcdErr) != nil || etcdErr.Message == "" {
+			etcdErr.Message = fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+		}
+		if etcdErr.Code != grpcUnauthenticated || token == "" || retried {
+			return nil, etcdErr
+		}
+		l.mutex.Lock()
+		if l.token == token {
+			l.token = ""
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// authenticate returns the token that authenticates requests, which is empty when the
+// endpoint has no user
+func (l *etcdLocker) authenticate(ctx context.Context) (string, error) {
+	if l.user == nil {
+		return "", nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.token != "" {
+		return l.token, nil
+	}
+
+	password, _ := l.user.Password()
+	body, err := json.Marshal(map[string]string{"name": l.user.Username(), "password": password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, l.endpoint+"/v3/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		etcdError
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &response.etcdError
+	}
+	l.token = response.Token
+	return l.token, nil
+}
+
+// call sends a request to an endpoint of the etcd API and decodes the response into
+// response. Streaming endpoints, like keeping a lease alive, wrap their response in a
+// result, which is unwrapped.
+func (l *etcdLocker) call(ctx context.Context, path string, request interface{}, response interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, EtcdTimeout)
+	defer cancel()
+	resp, err := l.post(ctx, path, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var message struct {
+		Result json.RawMessage `json:"result"`
+		Error  *etcdError      `json:"error"`
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return err
+	}
+	if message.Error != nil {
+		return message.Error
+	}
+	if message.Result != nil {
+		body = message.Result
+	}
+	return json.Unmarshal(body, response)
+}
+
+// compareOwner is a comparison of a transaction that holds while key holds owner
+func compareOwner(key, owner string) map[string]interface{} {
+	return map[string]interface{}{"key": encode(key), "target": "VALUE", "result": "EQUAL", "value": encode(owner)}
+}
+
+// revoke revokes a lease, which deletes every key that's attached to it
+func (l *etcdLocker) revoke(ctx context.Context, lease int64) error {
+	var response struct{}
+	err := l.call(ctx, "/v3/lease/revoke", map[string]interface{}{"ID": lease}, &response)
+	if eerr, ok := err.(*etcdError); ok && eerr.Code == grpcNotFound {
+		// The lease already expired
+		return nil
+	}
+	return err
+}
+
+func (l *etcdLocker) Acquire(ctx context.Context, request *lockRequest, now time.Time) (*lockAttempt, error) {
+	// The keys of a lock with a lease are attached to a lease of their own, which
+	// is revoked again when the locks can't be acquired
+	var lease int64
+	if request.Lease != 0 {
+		var granted etcdLeaseResponse
+		ttl := int64((request.Lease + time.Second - 1) / time.Second)
+		if err := l.call(ctx, "/v3/lease/grant", map[string]interface{}{"TTL": ttl}, &granted); err != nil {
+			return nil, err
+		}
+		lease = granted.ID
+	}
+
+	// Every key is created as long as none of them exists, or else they're all read
+	// to find out who holds them
+	var compare, success, failure []map[string]interface{}
+	for _, name := range request.Names {
+		key := encode(l.prefix + name)
+		compare = append(compare, map[string]interface{}{"key": key, "target": "CREATE", "result": "EQUAL", "create_revision": 0})
+		success = append(success, map[string]interface{}{"request_put": map[string]interface{}{"key": key, "value": encode(request.Token), "lease": lease}})
+		failure = append(failure, map[string]interface{}{"request_range": map[string]interface{}{"key": key}})
+	}
+	var txn etcdTxnResponse
+	err := l.call(ctx, "/v3/kv/txn", map[string]interface{}{"compare": compare, "success": success, "failure": failure}, &txn)
+	if err != nil {
+		return nil, err
+	}
+
+	attempt := &lockAttempt{Owner: request.Token}
+	if txn.Succeeded {
+		attempt.Acquired = true
+		for range request.Names {
+			attempt.Fences = append(attempt.Fences, txn.Header.Revision)
+		}
+		return attempt, nil
+	}
+
+	// The locks might be held by us already, when an earlier attempt went through
+	// after all, in which case they keep their fencing tokens
+	var fences []int64
+	for i, name := range request.Names {
+		var kv *etcdKeyValue
+		if i < len(txn.Responses) && txn.Responses[i].ResponseRange != nil && len(txn.Responses[i].ResponseRange.Kvs) > 0 {
+			kv = txn.Responses[i].ResponseRange.Kvs[0]
+		}
+		switch {
+		case kv == nil:
+			// This one is free, but another one isn't
+		case decode(kv.Value) != request.Token:
+			attempt.Waiting = append(attempt.Waiting, fmt.Sprintf("%s, held by owner %s", name, decode(kv.Value)))
+		default:
+			fences = append(fences, kv.CreateRevision)
+		}
+	}
+	if lease != 0 {
+		if err := l.revoke(ctx, lease); err != nil {
+			return nil, err
+		}
+	}
+	if len(attempt.Waiting) == 0 && len(fences) < len(request.Names) {
+		// We only hold some of the locks, when an earlier release of them failed half
+		// way, so they're given up to start over
+		if err := l.Release(ctx, request, request.Token, true); err != nil && err != errNotHolder {
+			return nil, err
+		}
+		attempt.Waiting = append(attempt.Waiting, fmt.Sprintf("%s, which were only held in part by owner %s", strings.Join(request.Names, ", "), request.Token))
+	}
+	if len(attempt.Waiting) > 0 {
+		l.revision = txn.Header.Revision
+		return attempt, nil
+	}
+	attempt.Acquired = true
+	attempt.Fences = fences
+	return attempt, nil
+}
+
+// Watch watches the keys of the locks from the revision of the last failed attempt to
+// acquire them, and closes the channel once any of them was written or deleted since
+func (l *etcdLocker) Watch(ctx context.Context, request *lockRequest) <-chan struct{} {
+	changed := make(chan struct{})
+	var once sync.Once
+	for _, name := range request.Names {
+		go func(key string) {
+			watch := map[string]interface{}{"create_request": map[string]interface{}{"key": encode(key), "start_revision": l.revision + 1}}
+			resp, err := l.post(ctx, "/v3/watch", watch)
+			if err != nil {
+				// Waiting jobs still try again once their backoff runs out
+				return
+			}
+			defer resp.Body.Close()
+
+			decoder := json.NewDecoder(resp.Body)
+			for {
+				var message struct {
+					Result struct {
+						Events []json.RawMessage `json:"events"`
+					} `json:"result"`
+				}
+				if err := decoder.Decode(&message); err != nil {
+					return
+				}
+				if len(message.Result.Events) > 0 {
+					once.Do(func() { close(changed) })
+					return
+				}
+			}
+		}(l.prefix + name)
+	}
+	return changed
+}
+
+func (l *etcdLocker) Release(ctx context.Context, request *lockRequest, owner string, holds bool) error {
+	// Nobody waits in line, so there's nothing to give up but holds
+	if !holds {
+		return errNotHolder
+	}
+	released := 0
+	leases := map[int64]bool{}
+	for _, name := range request.Names {
+		key := l.prefix + name
+		var txn etcdTxnResponse
+		err := l.call(ctx, "/v3/kv/txn", map[string]interface{}{
+			"compare": []interface{}{compareOwner(key, owner)},
+			"success": []interface{}{
+				map[string]interface{}{"request_range": map[string]interface{}{"key": encode(key)}},
+				map[string]interface{}{"request_delete_range": map[string]interface{}{"key": encode(key)}},
+			},
+		}, &txn)
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			continue
+		}
+		released++
+		if rng := txn.Responses[0].ResponseRange; rng != nil && len(rng.Kvs) > 0 && rng.Kvs[0].Lease != 0 {
+			leases[rng.Kvs[0].Lease] = true
+		}
+	}
+
+	// The keys are gone already, so the leases they were attached to aren't needed
+	// anymore
+	for lease := range leases {
+		if err := l.revoke(ctx, lease); err != nil {
+			return err
+		}
+	}
+	if released == 0 {
+		return errNotHolder
+	}
+	return nil
+}
+
+func (l *etcdLocker) Renew(ctx context.Context, request *lockRequest, owner string, now time.Time) (int64, error) {
+	// The heartbeat might run in a different process than the one that acquired the
+	// locks, so the leases to keep alive are read from the keys
+	leases := map[int64]bool{}
+	for _, name := range request.Names {
+		var kvs etcdRangeResponse
+		if err := l.call(ctx, "/v3/kv/range", map[string]interface{}{"key": encode(l.prefix + name)}, &kvs); err != nil {
+			return 0, err
+		}
+		if len(kvs.Kvs) == 0 || decode(kvs.Kvs[0].Value) != owner {
+			return 0, errNotHolder
+		}
+		leases[kvs.Kvs[0].Lease] = true
+	}
+
+	expiresAt := now.Add(request.Lease).Unix()
+	for lease := range leases {
+		if lease == 0 {
+			// A lock without a lease never expires
+			continue
+		}
+		var alive etcdLeaseResponse
+		if err := l.call(ctx, "/v3/lease/keepalive", map[string]interface{}{"ID": lease}, &alive); err != nil {
+			return 0, err
+		}
+		if alive.TTL <= 0 {
+			return 0, errNotHolder
+		}
+		if until := now.Unix() + alive.TTL; until < expiresAt {
+			expiresAt = until
+		}
+	}
+	return expiresAt, nil
+}
+
+func (l *etcdLocker) Inspect(ctx context.Context, names []string) (map[string]*lockState, error) {
+	states := map[string]*lockState{}
+	for _, name := range names {
+		var kvs etcdRangeResponse
+		if err := l.call(ctx, "/v3/kv/range", map[string]interface{}{"key": encode(l.prefix + name)}, &kvs); err != nil {
+			return nil, err
+		}
+		state := &lockState{}
+		if len(kvs.Kvs) > 0 {
+			kv := kvs.Kvs[0]
+			state.Fence = kv.CreateRevision
+			holder := &lockHolder{Mode: ModeExclusive, Fence: kv.CreateRevision}
+			if kv.Lease != 0 {
+				var ttl etcdLeaseResponse
+				if err := l.call(ctx, "/v3/lease/timetolive", map[string]interface{}{"ID": kv.Lease}, &ttl); err != nil {
+					return nil, err
+				}
+				holder.ExpiresAt = time.Now().Unix() + ttl.TTL
+			}
+			state.Holders = map[string]*lockHolder{decode(kv.Value): holder}
+		}
+		states[name] = state
+	}
+	return states, nil
+}
+
+// etcdErrorClass sorts errors that were returned by the etcd server by their gRPC
+// status code
+func etcdErrorClass(err *etcdError) string {
+	// Wrong or missing credentials are invalid arguments as far as etcd is concerned
+	if strings.Contains(err.Message, "authentication failed") || strings.Contains(err.Message, "user name is empty") {
+		return ErrorConfig
+	}
+	switch err.Code {
+	case grpcUnauthenticated, grpcPermissionDenied:
+		return ErrorConfig
+	case grpcUnavailable, grpcDeadlineExceeded, grpcResourceExhausted, grpcAborted:
+		return ErrorRetryable
+	}
+	return ErrorFatal
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// ReentrantRun lets every job in the same workflow run, across all of its attempts, re-enter a lock
+	ReentrantRun = "run"
+
+	// ReentrantRunAttempt lets every job in the same attempt of a workflow run re-enter a lock
+	ReentrantRunAttempt = "run-attempt"
+
+	// ReentrantJob lets the same job in the same attempt of a workflow run re-enter a lock
+	ReentrantJob = "job"
+)
+
+// newOwnerToken generates a random token that identifies a single holder of a lock
+func newOwnerToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ownerMetadata describes the GitHub Actions job that is running this process
+func ownerMetadata() *lockHolder {
+	return &lockHolder{
+		Repository: os.Getenv("GITHUB_REPOSITORY"),
+		RunID:      os.Getenv("GITHUB_RUN_ID"),
+		RunAttempt: os.Getenv("GITHUB_RUN_ATTEMPT"),
+		Job:        os.Getenv("GITHUB_JOB"),
+		Actor:      os.Getenv("GITHUB_ACTOR"),
+		SHA:        os.Getenv("GITHUB_SHA"),
+	}
+}
+
+// reentrancyScope identifies the owners that can re-enter each other's locks. Owners in
+// the same workflow run share the ReentrantRun scope, owners in the same attempt of the
+// run share the ReentrantRunAttempt scope, and owners in the same job of that attempt
+// share the ReentrantJob scope.
+func reentrancyScope(scope string) (string, error) {
+	repository := os.Getenv("GITHUB_REPOSITORY")
+	runID := os.Getenv("GITHUB_RUN_ID")
+	runAttempt := os.Getenv("GITHUB_RUN_ATTEMPT")
+	job := os.Getenv("GITHUB_JOB")
+	if runID == "" {
+		return "", errors.New("re-entering locks is only possible inside of a GitHub Actions workflow run")
+	}
+
+	switch scope {
+	case ReentrantRun:
+		return fmt.Sprintf("%s/%s", repository, runID), nil
+	case ReentrantRunAttempt:
+		return fmt.Sprintf("%s/%s/%s", repository, runID, runAttempt), nil
+	case ReentrantJob:
+		return fmt.Sprintf("%s/%s/%s/%s", repository, runID, runAttempt, job), nil
+	}
+	return "", fmt.Errorf("unknown scope %q, expected %q, %q or %q", scope, ReentrantRun, ReentrantRunAttempt, ReentrantJob)
+}
+
+// appendFileCommand writes a name=value pair to the GitHub Actions command file
+// named by env. It does nothing when we're not running inside of GitHub Actions.
+func appendFileCommand(env, name, value string) error {
+	path := os.Getenv(env)
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s=%s\n", name, value)
+	return err
+}
+
+// saveState stores a value for the post-entrypoint of this action to read back with getState
+func saveState(name, value string) error {
+	return appendFileCommand("GITHUB_STATE", name, value)
+}
+
+// getState reads a value that was stored by saveState during the main entrypoint
+func getState(name string) string {
+	return os.Getenv("STATE_" + name)
+}
+
+// setOutput sets an output of this action for later steps to read
+func setOutput(name, value string) error {
+	return appendFileCommand("GITHUB_OUTPUT", name, value)
+}
+
+// exportEnv sets an environment variable for all of the later steps in the job
+func exportEnv(name, value string) error {
+	return appendFileCommand("GITHUB_ENV", name, value)
+}
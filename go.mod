@@ -4,6 +4,8 @@ go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.32.0
+	github.com/gomodule/redigo v1.8.5
+	github.com/lib/pq v1.10.9
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.7.0
 )
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// HeartbeatIntervalVar is the key for the setting to control how often the lease on a lock is renewed
+	HeartbeatIntervalVar = "interval"
+
+	// HeartbeatOnLostVar is the key for the setting to control what happens when the lease on a lock is lost
+	HeartbeatOnLostVar = "on-lost"
+
+	// HeartbeatHoldUntilVar is the key for the setting to control when the max-hold of the lock runs out, in epoch seconds
+	HeartbeatHoldUntilVar = "hold-until"
+
+	// HeartbeatPIDVar is the key for the setting to control which process the lock protects, which is killed when the lease on a lock is lost
+	HeartbeatPIDVar = "pid"
+
+	// HeartbeatEndpointEnv is the name of the environment variable that the endpoint of the backend is handed to the heartbeat in, so that credentials in it don't show up in the process list
+	HeartbeatEndpointEnv = "LOCK_HEARTBEAT_ENDPOINT"
+
+	// OnLostWarn only reports that the lease on a lock was lost
+	OnLostWarn = "warn"
+
+	// OnLostKill reports that the lease on a lock was lost and terminates the process doing the protected work
+	OnLostKill = "kill"
+)
+
+// errLockLost is returned by keepRenewing when a lock was taken over by someone else
+var errLockLost = errors.New("lock was taken over after its lease ran out or its max-hold was exceeded")
+
+// MaxHoldWarnings are how long before its max-hold runs out the holder of a lock is warned
+var MaxHoldWarnings = []time.Duration{15 * time.Minute, 5 * time.Minute, time.Minute}
+
+// keepRenewing renews the lease of owner on the locks of request every interval,
+// until ctx is done or the locks are released. It returns errLockLost once the locks
+// were taken over by somebody else.
+func keepRenewing(ctx context.Context, locker Locker, request *lockRequest, owner string, interval time.Duration) error {
+	// The first renewal happens right away, while the lock was only just
+	// acquired, so that we know when our lease runs out from then on
+	var expiresAt int64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		renewed, err := locker.Renew(ctx, request, owner, time.Now())
+		switch {
+		case err == nil:
+			expiresAt = renewed
+			log.Print("Lease renewed")
+		case err == errNotHolder && time.Now().Unix() <= expiresAt:
+			// Only the owner removes itself from a lock before its lease runs out
+			log.Print("Lock was released, no longer renewing lease")
+			return nil
+		case err == errNotHolder:
+			return errLockLost
+		case ctx.Err() != nil:
+			// The renewal was cut short because we're stopping
+		default:
+			// Keep trying, the lease might still be renewed before it runs out
+			log.Printf("Failed to renew lease: %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Print("No longer renewing lease")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchProcess checks every interval whether the process with the given pid is still
+// running, and closes the returned channel once it's gone, until ctx is done
+func watchProcess(ctx context.Context, pid int, interval time.Duration) <-chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Signal 0 only checks that the process exists
+			if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+				close(exited)
+				return
+			}
+		}
+	}()
+	return exited
+}
+
+// warnMaxHold logs a warning whenever the max-hold of the locks gets within one of
+// MaxHoldWarnings of running out, and once it ran out, until ctx is done. It does
+// nothing when there's no max-hold.
+func warnMaxHold(ctx context.Context, name string, holdUntil int64) {
+	if holdUntil == 0 {
+		return
+	}
+	deadline := time.Unix(holdUntil, 0)
+	for _, before := range append(MaxHoldWarnings, 0) {
+		wait := time.Until(deadline.Add(-before))
+		if wait < 0 && before > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if before > 0 {
+			log.Printf("::warning::Lock %s exceeds its max-hold in %v, after which waiting jobs can break it", name, before)
+		} else {
+			log.Printf("::warning::Lock %s exceeded its max-hold, waiting jobs can break it now", name)
+		}
+	}
+}
+
+// startHeartbeat runs the heartbeat command as a detached process, so that it
+// outlives this one and keeps renewing the lease for as long as the job runs
+func startHeartbeat(config *lockConfig, request *lockRequest, attempt *lockAttempt, pid int) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	logPath := filepath.Join(os.TempDir(), fmt.Sprintf("github-action-locks-heartbeat-%s.log", attempt.Owner))
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+
+	heartbeat := exec.Command(exe, "heartbeat",
+		"--"+LockBackendVar, config.Backend,
+		"--"+LockTableVar, config.Table,
+		"--"+LockKeyNameVar, config.Key,
+		"--"+LockBucketVar, config.Bucket,
+		"--"+LockPrefixVar, config.Prefix,
+		"--"+LockNameVar, strings.Join(request.Names, ","),
+		"--"+LockTokenVar, attempt.Owner,
+		"--"+LockLeaseVar, request.Lease.String(),
+		"--"+LockHierarchicalVar+"="+strconv.FormatBool(request.Hierarchical),
+		"--"+HeartbeatIntervalVar, config.HeartbeatInterval.String(),
+		"--"+HeartbeatOnLostVar, config.HeartbeatOnLost,
+		"--"+HeartbeatHoldUntilVar, strconv.FormatInt(attempt.HoldUntil, 10),
+		"--"+HeartbeatPIDVar, strconv.Itoa(pid),
+	)
+	heartbeat.Env = append(os.Environ(), HeartbeatEndpointEnv+"="+config.Endpoint)
+	heartbeat.Stdout = logFile
+	heartbeat.Stderr = logFile
+	heartbeat.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := heartbeat.Start(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Heartbeat is logging to %s", logPath)
+	// Releasing the process forgets its pid
+	started := heartbeat.Process.Pid
+	return started, heartbeat.Process.Release()
+}
+
+func heartbeat() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "heartbeat",
+		Short: "Keep renewing the lease on a held lock",
+		Run: func(cmd *cobra.Command, _ []string) {
+			LockBackend, _ := cmd.Flags().GetString(LockBackendVar)
+			LockTable, _ := cmd.Flags().GetString(LockTableVar)
+			LockKeyName, _ := cmd.Flags().GetString(LockKeyNameVar)
+			LockBucket, _ := cmd.Flags().GetString(LockBucketVar)
+			LockPrefix, _ := cmd.Flags().GetString(LockPrefixVar)
+			LockEndpoint, _ := cmd.Flags().GetString(LockEndpointVar)
+			if LockEndpoint == "" {
+				LockEndpoint = os.Getenv(HeartbeatEndpointEnv)
+			}
+			LockName, _ := cmd.Flags().GetString(LockNameVar)
+			LockToken, _ := cmd.Flags().GetString(LockTokenVar)
+			LockLease, _ := cmd.Flags().GetDuration(LockLeaseVar)
+			LockHierarchical, _ := cmd.Flags().GetBool(LockHierarchicalVar)
+			HeartbeatInterval, _ := cmd.Flags().GetDuration(HeartbeatIntervalVar)
+			HeartbeatOnLost, _ := cmd.Flags().GetString(HeartbeatOnLostVar)
+			HeartbeatPID, _ := cmd.Flags().GetInt(HeartbeatPIDVar)
+			HeartbeatHoldUntil, _ := cmd.Flags().GetInt64(HeartbeatHoldUntilVar)
+
+			LockNames, err := lockNames(LockName)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", LockNameVar, err)
+			}
+			if LockToken == "" {
+				log.Fatal("An owner token is required to renew a lock")
+			}
+			if LockLease <= 0 {
+				log.Fatal("A lease is required to renew a lock")
+			}
+			if HeartbeatInterval <= 0 {
+				HeartbeatInterval = LockLease / 3
+			}
+			if HeartbeatOnLost != OnLostWarn && HeartbeatOnLost != OnLostKill {
+				log.Fatalf("Unknown %s action %q, expected %q or %q", HeartbeatOnLostVar, HeartbeatOnLost, OnLostWarn, OnLostKill)
+			}
+
+			log.Printf("Renewing lease on lock %s every %v", LockName, HeartbeatInterval)
+
+			go warnMaxHold(cmd.Context(), LockName, HeartbeatHoldUntil)
+
+			// Renewing doesn't depend on how the locks are held, so the rest of the
+			// settings keep their defaults, which every backend supports
+			locker, err := newLocker(&lockConfig{
+				Backend:      LockBackend,
+				Table:        LockTable,
+				Key:          LockKeyName,
+				Bucket:       LockBucket,
+				Prefix:       LockPrefix,
+				Endpoint:     LockEndpoint,
+				Names:        LockNames,
+				Permits:      DefaultLockPermits,
+				Mode:         DefaultLockMode,
+				Priority:     DefaultLockPriority,
+				Hierarchical: LockHierarchical,
+			})
+			if err != nil {
+				log.Fatalf("Failed to set up %s backend: %+v", LockBackend, err)
+			}
+			request := &lockRequest{Names: LockNames, Lease: LockLease, Hierarchical: LockHierarchical}
+
+			// The lock is only renewed for as long as the process it protects runs, so
+			// that a script that crashed before it could unlock doesn't hold the lock
+			// forever
+			ctx, stopRenewing := context.WithCancel(cmd.Context())
+			defer stopRenewing()
+			var exited <-chan struct{}
+			if HeartbeatPID > 0 {
+				exited = watchProcess(ctx, HeartbeatPID, HeartbeatInterval)
+			}
+			go func() {
+				select {
+				case <-exited:
+					stopRenewing()
+				case <-ctx.Done():
+				}
+			}()
+			err = keepRenewing(ctx, locker, request, LockToken, HeartbeatInterval)
+			select {
+			case <-exited:
+				log.Printf("Process %d exited without releasing lock %s, releasing it", HeartbeatPID, LockName)
+				releaseCtx, cancel := context.WithTimeout(context.Background(), CleanupTimeout)
+				defer cancel()
+				err := retryContended(releaseCtx, CleanupTimeout, wallClock{}, func() error {
+					return locker.Release(releaseCtx, request, LockToken, true)
+				})
+				switch err {
+				case nil:
+					log.Print("Lock released")
+				case errNotHolder:
+					log.Print("Lock is not held by this owner anymore, leaving it in place")
+				default:
+					log.Printf("Failed to release lock: %+v", err)
+				}
+				return
+			default:
+			}
+			if err == errLockLost {
+				log.Printf("::error::LOST LOCK %s: %v", LockName, err)
+				if HeartbeatOnLost == OnLostKill && HeartbeatPID > 0 {
+					log.Printf("Terminating process %d that was protected by the lock", HeartbeatPID)
+					if err := syscall.Kill(HeartbeatPID, syscall.SIGTERM); err != nil {
+						log.Printf("Failed to terminate process %d: %+v", HeartbeatPID, err)
+					}
+				}
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.PersistentFlags().String(LockBackendVar, DefaultLockBackend, "Backend the lock is kept in")
+	cmd.PersistentFlags().String(LockTableVar, DefaultLockTable, "DynamoDB table the lock is written in")
+	cmd.PersistentFlags().String(LockKeyNameVar, DefaultLockKeyName, "Name of the column where we write locks")
+	cmd.PersistentFlags().String(LockBucketVar, "", "S3 bucket the lock is written in")
+	cmd.PersistentFlags().String(LockPrefixVar, DefaultLockPrefix, "Prefix of the keys that locks are written at")
+	cmd.PersistentFlags().String(LockEndpointVar, "", "Endpoint of the backend, defaults to $"+HeartbeatEndpointEnv)
+	cmd.PersistentFlags().String(LockNameVar, DefaultLockName, "Name of the lock, or a comma separated list of locks that were acquired together")
+	cmd.PersistentFlags().String(LockTokenVar, "", "Owner token of the lock to renew")
+	cmd.PersistentFlags().Duration(LockLeaseVar, DefaultLockLease, "How far to push out the expiry of the lock on every renewal")
+	cmd.PersistentFlags().Bool(LockHierarchicalVar, false, "Whether the lock was acquired as hierarchical")
+	cmd.PersistentFlags().Duration(HeartbeatIntervalVar, 0, "How often to renew the lease, defaults to a third of the lease")
+	cmd.PersistentFlags().String(HeartbeatOnLostVar, OnLostWarn, "What to do when the lease is lost, either warn or kill")
+	cmd.PersistentFlags().Int64(HeartbeatHoldUntilVar, 0, "When the max-hold of the lock runs out in epoch seconds, to warn about ahead of time")
+	cmd.PersistentFlags().Int(HeartbeatPIDVar, 0, "Process the lock protects, which is terminated when the lease is lost and on-lost is kill, and after which the lock is released once it exits")
+
+	return cmd
+}
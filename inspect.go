@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// logLockState logs who holds the lock and who is waiting for it, in the order they
+// get it
+func logLockState(name string, state *lockState, now int64) {
+	log.Printf("Lock %s has been acquired %d times, %d owners hold it and %d are waiting", name, state.Fence, len(state.Holders), len(state.Queue))
+	for token, holder := range state.Holders {
+		status := "without a lease"
+		switch {
+		case holder.overdue(now):
+			status = "exceeded its max-hold"
+		case holder.expired(now):
+			status = "lease ran out"
+		case holder.ExpiresAt != 0:
+			status = "leased until " + time.Unix(holder.ExpiresAt, 0).UTC().Format(time.RFC3339)
+		}
+		log.Printf("  %s holds it %s since %s with fencing token %d, %s, by %s in run %s of %s",
+			token, holder.Mode, holder.AcquiredAt, holder.Fence, status, holder.Actor, holder.RunID, holder.Repository)
+	}
+	for i, token := range state.queue() {
+		ticket := state.Queue[token]
+		log.Printf("  %s is waiting at position %d for it %s with priority %d", token, i+1, ticket.Mode, ticket.Priority)
+	}
+	for token, intent := range state.Intents {
+		log.Printf("  %s holds %d locks below it %s", token, intent.Count, intent.Mode)
+	}
+	for token, ticket := range state.Below {
+		log.Printf("  %s is waiting for locks below it %s with priority %d", token, ticket.Mode, ticket.Priority)
+	}
+}
+
+func inspect() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   CommandInspect,
+		Short: "Show who holds a lock and who is waiting for it",
+		Run: func(cmd *cobra.Command, _ []string) {
+			config, err := loadConfig(cmd, CommandInspect)
+			if err != nil {
+				log.Printf("Invalid settings: %v", err)
+				os.Exit(ExitConfig)
+			}
+			locker, err := newLocker(config)
+			if err != nil {
+				log.Printf("Failed to set up %s backend: %+v", config.Backend, err)
+				os.Exit(ExitConfig)
+			}
+
+			states, err := locker.Inspect(cmd.Context(), config.Names)
+			if err != nil {
+				log.Printf("Failed to inspect lock, with a %s error: %+v", errorClass(err), err)
+				os.Exit(exitCode(err))
+			}
+			now := time.Now().Unix()
+			for _, name := range config.Names {
+				logLockState(name, states[name], now)
+			}
+		},
+	}
+
+	addSettingFlags(cmd, LockBackendVar, LockTableVar, LockKeyNameVar, LockBucketVar, LockPrefixVar, LockEndpointVar, LockNameVar)
+	return cmd
+}
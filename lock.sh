@@ -1,3 +1,11 @@
 #!/bin/sh
 set -e
-/go/bin/github-action-locks lock
+status=0
+/go/bin/github-action-locks lock || status=$?
+
+# Not getting a lock that we weren't going to wait for isn't a failure, later
+# steps can check the acquired output instead
+if [ "$status" -eq 6 ]; then
+  exit 0
+fi
+exit $status
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Locker keeps locks somewhere that every job can reach. The acquisition loop,
+// heartbeat and commands only ever go through a Locker, so they work the same way
+// whichever backend the locks are kept in.
+type Locker interface {
+	// Acquire makes a single attempt at acquiring all of the locks of request at time
+	// now. When they can't all be acquired, none of them are, and a request that waits
+	// keeps its place in line for them.
+	Acquire(ctx context.Context, request *lockRequest, now time.Time) (*lockAttempt, error)
+
+	// Release gives up the places in line of owner for the locks of request, and with
+	// holds also a hold on each of the locks. It returns errNotHolder when owner
+	// neither held nor waited for any of them.
+	Release(ctx context.Context, request *lockRequest, owner string, holds bool) error
+
+	// Renew pushes out the lease of owner on the locks of request by the lease of
+	// request from now, and returns when the first of them can be taken over by
+	// someone else, in epoch seconds. It returns errNotHolder when owner doesn't hold
+	// all of the locks anymore.
+	Renew(ctx context.Context, request *lockRequest, owner string, now time.Time) (int64, error)
+
+	// Inspect returns the current state of each of the locks
+	Inspect(ctx context.Context, names []string) (map[string]*lockState, error)
+}
+
+// lockWatcher is implemented by lockers that can tell when the locks change, so that
+// waiting jobs try again as soon as a lock might have been released rather than once
+// their backoff runs out
+type lockWatcher interface {
+	// Watch returns a channel that's closed once any of the locks of request changed
+	// since the last attempt to acquire them, until ctx is done
+	Watch(ctx context.Context, request *lockRequest) <-chan struct{}
+}
+
+// backendFactory sets up a Locker from the settings
+type backendFactory func(config *lockConfig) (Locker, error)
+
+// backends are the backends that locks can be kept in, keyed by name
+var backends = map[string]backendFactory{}
+
+// registerBackend makes a backend available under name. Backends register
+// themselves from an init function in their own file.
+func registerBackend(name string, factory backendFactory) {
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("backend %s is registered twice", name))
+	}
+	backends[name] = factory
+}
+
+// backendNames returns the names of every registered backend, sorted
+func backendNames() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newLocker sets up the backend that the settings point at
+func newLocker(config *lockConfig) (Locker, error) {
+	factory, ok := backends[config.Backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %q, expected one of %s", LockBackendVar, config.Backend, strings.Join(backendNames(), ", "))
+	}
+	return factory(config)
+}
+
+// requireSingleOwner checks that the settings only ask for what backend supports when
+// a lock only has room for a single owner, which rules out permits, shared holders,
+// queues and hierarchies
+func requireSingleOwner(config *lockConfig, backend string) error {
+	switch {
+	case config.Permits != DefaultLockPermits:
+		return fmt.Errorf("the %s backend only supports a single holder, got %d %s", backend, config.Permits, LockPermitsVar)
+	case config.Mode != ModeExclusive:
+		return fmt.Errorf("the %s backend only supports %s locks", backend, ModeExclusive)
+	case config.Priority != DefaultLockPriority:
+		return fmt.Errorf("the %s backend doesn't keep a queue to order by %s", backend, LockPriorityVar)
+	case config.Reentrant != "":
+		return fmt.Errorf("the %s backend doesn't support %s locks", backend, LockReentrantVar)
+	case config.Hierarchical:
+		return fmt.Errorf("the %s backend doesn't support %s locks", backend, LockHierarchicalVar)
+	case config.MaxHold != 0:
+		return fmt.Errorf("the %s backend doesn't support a %s, use a %s instead", backend, LockMaxHoldVar, LockLeaseVar)
+	}
+	return nil
+}
+
+// lockStore keeps the state of locks, holders, queues and intents included, for
+// backends that can only store and conditionally overwrite a document per lock
+type lockStore interface {
+	// loadLocks reads the current state of each of the locks, all as of the same
+	// point in time. A lock that was never written has an empty state.
+	loadLocks(ctx context.Context, names []string) (map[string]*lockState, error)
+
+	// updateLocks applies change to the current state of the locks and writes them
+	// back, all or nothing. It returns errVersionConflict without writing anything
+	// when somebody else wrote one of the locks in the meantime, see retryConflicts.
+	// Any error returned by change stops the update without writing anything.
+	updateLocks(ctx context.Context, names []string, change func(map[string]*lockState) error) error
+}
+
+const (
+	// MaxConflictRetries is how many times an update of the locks starts over because
+	// somebody else wrote them in the meantime, before it gives up
+	MaxConflictRetries = 10
+
+	// ConflictBackoffMin is the shortest wait before starting an update over
+	ConflictBackoffMin = 20 * time.Millisecond
+
+	// ConflictBackoffMax is the longest wait before starting an update over
+	ConflictBackoffMax = time.Second
+)
+
+// retryConflicts calls update until it doesn't fail with errVersionConflict, waiting
+// a random time on clock in between so that everyone writing the same locks doesn't
+// start over at the same moment. It returns errVersionConflict once update conflicted
+// MaxConflictRetries times in a row.
+func retryConflicts(ctx context.Context, clock clock, update func() error) error {
+	backoff := newBackoff(BackoffDecorrelatedJitter, ConflictBackoffMin, ConflictBackoffMax, 3, newRandom())
+	for retries := 0; ; retries++ {
+		err := update()
+		if err != errVersionConflict || retries == MaxConflictRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(backoff.next()):
+		}
+	}
+}
+
+// storeLocker is a Locker that makes every decision about who gets a lock itself, on
+// top of a lockStore. It waits on clock before starting over after a conflict.
+type storeLocker struct {
+	store lockStore
+	clock clock
+}
+
+// update applies change to the locks, starting over whenever somebody else wrote one
+// of them in the meantime
+func (l *storeLocker) update(ctx context.Context, names []string, change func(map[string]*lockState) error) error {
+	return retryConflicts(ctx, l.clock, func() error {
+		return l.store.updateLocks(ctx, names, change)
+	})
+}
+
+func (l *storeLocker) Acquire(ctx context.Context, request *lockRequest, now time.Time) (*lockAttempt, error) {
+	var attempt *lockAttempt
+	err := l.update(ctx, lockItems(request.Names, request.Hierarchical), func(states map[string]*lockState) error {
+		var err error
+		attempt, err = request.attempt(states, now)
+		return err
+	})
+	return attempt, err
+}
+
+func (l *storeLocker) Release(ctx context.Context, request *lockRequest, owner string, holds bool) error {
+	return l.update(ctx, lockItems(request.Names, request.Hierarchical), func(states map[string]*lockState) error {
+		released := request.abandon(states, owner)
+		if holds && releaseLocks(states, request.Names, owner, request.Hierarchical) {
+			released = true
+		}
+		if !released {
+			return errNotHolder
+		}
+		return nil
+	})
+}
+
+func (l *storeLocker) Renew(ctx context.Context, request *lockRequest, owner string, now time.Time) (int64, error) {
+	var deadline int64
+	err := l.update(ctx, lockItems(request.Names, request.Hierarchical), func(states map[string]*lockState) error {
+		var err error
+		deadline, err = renewLocks(states, request.Names, owner, request.Hierarchical, now.Add(request.Lease).Unix())
+		return err
+	})
+	return deadline, err
+}
+
+func (l *storeLocker) Inspect(ctx context.Context, names []string) (map[string]*lockState, error) {
+	return l.store.loadLocks(ctx, names)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// conflictingStore is a memoryStore whose first updates fail as if somebody else
+// wrote the locks in the meantime
+type conflictingStore struct {
+	*memoryStore
+	conflicts int
+	updates   int
+}
+
+func (s *conflictingStore) updateLocks(ctx context.Context, names []string, change func(map[string]*lockState) error) error {
+	s.updates++
+	if s.updates <= s.conflicts {
+		return errVersionConflict
+	}
+	return s.memoryStore.updateLocks(ctx, names, change)
+}
+
+// newConflictingLocker returns a Locker whose locks live in memory, and that waits
+// on clock after conflicts
+func newConflictingLocker(clock clock) (*storeLocker, *conflictingStore) {
+	store := &conflictingStore{memoryStore: &memoryStore{locks: map[string][]byte{}}}
+	return &storeLocker{store: store, clock: clock}, store
+}
+
+func TestStoreLockerRetriesConflicts(t *testing.T) {
+	clock := newFakeClock()
+	locker, store := newConflictingLocker(clock)
+	store.conflicts = MaxConflictRetries
+
+	attempt, err := locker.Acquire(context.Background(), testRequest("first", "deploy"), clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attempt.Acquired {
+		t.Fatal("expected the lock to be acquired once the conflicts were over")
+	}
+	if len(clock.waits) != MaxConflictRetries {
+		t.Errorf("expected a wait on the clock after each of %d conflicts, got %v", MaxConflictRetries, clock.waits)
+	}
+	for _, wait := range clock.waits {
+		if wait < ConflictBackoffMin || wait > ConflictBackoffMax {
+			t.Errorf("expected waits between %v and %v, got %v", ConflictBackoffMin, ConflictBackoffMax, wait)
+		}
+	}
+
+	// One more conflict than that gives up
+	store.updates, store.conflicts = 0, MaxConflictRetries+1
+	if _, err := locker.Acquire(context.Background(), testRequest("second", "deploy"), clock.Now()); err != errVersionConflict {
+		t.Errorf("expected %v, got %v", errVersionConflict, err)
+	}
+}
+
+func TestRetryContendedRelease(t *testing.T) {
+	clock := newFakeClock()
+	locker, store := newConflictingLocker(clock)
+	request := testRequest("first", "deploy")
+	mustAcquire(t, locker, request, clock)
+
+	// Releasing keeps going through conflicts for as long as the budget lasts
+	store.updates, store.conflicts = 0, 5*(MaxConflictRetries+1)
+	err := retryContended(context.Background(), 2*time.Minute, clock, func() error {
+		return locker.Release(context.Background(), request, "first", true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, locker, "deploy"); len(got) != 0 {
+		t.Errorf("expected deploy to be released, held by %v", got)
+	}
+
+	// but not for longer
+	mustAcquire(t, locker, request, clock)
+	store.updates, store.conflicts = 0, 1000000
+	start := clock.Now()
+	err = retryContended(context.Background(), 10*time.Second, clock, func() error {
+		return locker.Release(context.Background(), request, "first", true)
+	})
+	if err != errVersionConflict {
+		t.Fatalf("expected %v, got %v", errVersionConflict, err)
+	}
+	if waited := clock.Now().Sub(start); waited < 10*time.Second || waited > 10*time.Second+ConflictBackoffMax*MaxConflictRetries {
+		t.Errorf("expected to give up once the budget of 10s ran out, gave up after %v", waited)
+	}
+}
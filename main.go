@@ -2,165 +2,409 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 const (
-	// LockTimeoutVar is the key for the setting to control how long to wait to acquire a lock, in minutes
+	// LockTimeoutVar is the key for the setting to control how long to wait to acquire a lock, in minutes.
+	// It's superseded by LockAcquireTimeoutVar.
 	LockTimeoutVar = "timeout"
 
+	// LockAcquireTimeoutVar is the key for the setting to control how long to wait to acquire a lock
+	LockAcquireTimeoutVar = "acquire-timeout"
+
+	// LockMaxHoldVar is the key for the setting to control how long a lock can be held before waiters can break it
+	LockMaxHoldVar = "max-hold"
+
+	// LockBackendVar is the key for the setting to control which backend the lock is kept in
+	LockBackendVar = "backend"
+
 	// LockTableVar is the key for the setting to control the DynamoDB table to write the lock in
 	LockTableVar = "table"
 
+	// LockBucketVar is the key for the setting to control the S3 bucket to write the lock in
+	LockBucketVar = "bucket"
+
+	// LockPrefixVar is the key for the setting to control the prefix of the keys that locks are written at
+	LockPrefixVar = "prefix"
+
+	// LockEndpointVar is the key for the setting to control the endpoint of the backend, instead of the one of AWS
+	LockEndpointVar = "endpoint"
+
 	// LockKeyNameVar is the key for the setting to control the name of the column where we write locks
 	LockKeyNameVar = "key"
 
 	// LockNameVar is the key for the setting to control the name of the lock
 	LockNameVar = "name"
 
+	// LockLeaseVar is the key for the setting to control how long a lock is held before it expires
+	LockLeaseVar = "lease"
+
+	// LockHeartbeatVar is the key for the setting to control whether a detached process keeps renewing the lease
+	LockHeartbeatVar = "heartbeat"
+
+	// LockHeartbeatIntervalVar is the key for the setting to control how often the heartbeat renews the lease
+	LockHeartbeatIntervalVar = "heartbeat-interval"
+
+	// LockHeartbeatOnLostVar is the key for the setting to control what the heartbeat does when the lease is lost
+	LockHeartbeatOnLostVar = "heartbeat-on-lost"
+
+	// LockHeartbeatPIDVar is the key for the setting to control which process the heartbeat watches while it renews the lease
+	LockHeartbeatPIDVar = "heartbeat-pid"
+
+	// LockTokenVar is the key for the setting to control the owner token written on the lock
+	LockTokenVar = "token"
+
+	// LockModeVar is the key for the setting to control whether the lock is held shared or exclusive
+	LockModeVar = "mode"
+
+	// LockPriorityVar is the key for the setting to control the place in the queue while waiting for the lock
+	LockPriorityVar = "priority"
+
+	// LockReentrantVar is the key for the setting to control which owners can re-enter a lock they already hold
+	LockReentrantVar = "reentrant"
+
+	// LockHierarchicalVar is the key for the setting to control whether lock names are paths that conflict with the locks above and below them
+	LockHierarchicalVar = "hierarchical"
+
+	// LockAdvisoryVar is the key for the setting to control whether run holds Postgres session advisory locks instead of rows of the lock table
+	LockAdvisoryVar = "advisory"
+
+	// LockWaitVar is the key for the setting to control whether to wait for a lock that is held, or give up right away
+	LockWaitVar = "wait"
+
+	// LockBackoffVar is the key for the setting to control how the wait between attempts to acquire a lock grows
+	LockBackoffVar = "backoff"
+
+	// LockBackoffMinVar is the key for the setting to control the shortest wait between attempts to acquire a lock
+	LockBackoffMinVar = "backoff-min"
+
+	// LockBackoffMaxVar is the key for the setting to control the longest wait between attempts to acquire a lock
+	LockBackoffMaxVar = "backoff-max"
+
+	// LockBackoffMultiplierVar is the key for the setting to control how fast the wait between attempts grows
+	LockBackoffMultiplierVar = "backoff-multiplier"
+
+	// LockRetryBudgetVar is the key for the setting to control how long to keep retrying while DynamoDB is throttling or failing
+	LockRetryBudgetVar = "retry-budget"
+
+	// LockPermitsVar is the key for the setting to control how many owners can hold the lock at once
+	LockPermitsVar = "permits"
+
 	// DefaultLockTimeout is the default time, in minutes, for how long to wait to acquire a lock before giving up
 	DefaultLockTimeout = 30
 
+	// DefaultLockAcquireTimeout is the default time for how long to wait to acquire a lock before giving up
+	DefaultLockAcquireTimeout = DefaultLockTimeout * time.Minute
+
+	// DefaultLockMaxHold is the default longest time a lock can be held. A max-hold of 0 means there's no maximum.
+	DefaultLockMaxHold = 0
+
+	// DefaultLockBackend is the default backend to keep the lock in
+	DefaultLockBackend = BackendDynamoDB
+
 	// DefaultLockTable is the default name of the DynamoDB table to write the lock in
 	DefaultLockTable = "github-action-locks"
 
+	// DefaultLockPrefix is the default prefix of the keys that locks are written at
+	DefaultLockPrefix = "github-action-locks/"
+
 	// DefaultLockKeyName is the default name of the column where we write locks
 	DefaultLockKeyName = "LockID"
 
 	// DefaultLockName is the default name for the lock to create
 	DefaultLockName = "foobar"
+
+	// DefaultLockLease is the default lease on a lock. A lease of 0 means the lock never expires.
+	DefaultLockLease = 0
+
+	// MinLockLease is the shortest lease on a lock, so that renewing it doesn't turn into a busy loop of writes
+	MinLockLease = time.Second
+
+	// DefaultLockPermits is the default number of owners that can hold the lock at once
+	DefaultLockPermits = 1
+
+	// DefaultLockMode is the default mode to hold the lock in
+	DefaultLockMode = ModeExclusive
+
+	// DefaultLockPriority is the default priority of waiting for the lock
+	DefaultLockPriority = 0
+
+	// DefaultLockBackoff is the default strategy for waiting between attempts to acquire a lock
+	DefaultLockBackoff = BackoffExponential
+
+	// DefaultLockBackoffMin is the default shortest wait between attempts to acquire a lock
+	DefaultLockBackoffMin = 500 * time.Millisecond
+
+	// DefaultLockBackoffMax is the default longest wait between attempts to acquire a lock
+	DefaultLockBackoffMax = 10 * time.Second
+
+	// DefaultLockBackoffMultiplier is the default factor the wait between attempts grows by
+	DefaultLockBackoffMultiplier = 2.0
+
+	// DefaultLockRetryBudget is the default time to keep retrying while DynamoDB is throttling or failing
+	DefaultLockRetryBudget = 2 * time.Minute
+
+	// TicketLease is how long a waiting owner keeps its place in the queue after it
+	// last tried to acquire the lock
+	TicketLease = 30 * time.Second
+
+	// CleanupTimeout is how long we keep trying to give up on a lock after we were cancelled
+	CleanupTimeout = 10 * time.Second
+)
+
+const (
+	// VersionAttr is the attribute holding the version of a lock, which is incremented on every write
+	VersionAttr = "Version"
+
+	// LegacyOwnerAttr is the attribute that versions from before lock states had a Version held the owner token in
+	LegacyOwnerAttr = "Owner"
+
+	// LegacyExpiresAtAttr is the attribute that versions from before lock states had a Version held the end of the lease in
+	LegacyExpiresAtAttr = "ExpiresAt"
+
+	// FenceAttr is the attribute holding the fencing token of a lock in its fence counter item
+	FenceAttr = "Fence"
+
+	// LegacyOwner stands in for the owner of a lock that was written by the first version, which didn't record owners
+	LegacyOwner = "an older version"
+
+	// FencingTokenOutput is the name of the action output holding the fencing token
+	FencingTokenOutput = "fencing-token"
+
+	// AcquiredOutput is the name of the action output holding whether the lock was acquired
+	AcquiredOutput = "acquired"
+
+	// FencingTokenEnv is the name of the environment variable that later steps can read the fencing token from
+	FencingTokenEnv = "LOCK_FENCING_TOKEN"
+)
+
+const (
+	// CommandLock acquires locks that outlive it, until they're released by CommandUnlock
+	CommandLock = "lock"
+
+	// CommandUnlock releases locks that were acquired by CommandLock
+	CommandUnlock = "unlock"
+
+	// CommandRun holds locks for as long as the command it runs
+	CommandRun = "run"
+
+	// CommandInspect shows who holds locks and who is waiting for them
+	CommandInspect = "inspect"
 )
 
+// errLockHeld is returned while trying to acquire a lock that has no permits left
+var errLockHeld = errors.New("lock is held")
+
+// errScopeConflict is returned while re-entering locks that are held by different owners in the same scope
+var errScopeConflict = errors.New("locks are held by different owners in the same reentrancy scope")
+
+// errLockTimeout is returned when the timeout runs out while waiting to acquire a lock
+var errLockTimeout = errors.New("timed out waiting to acquire lock")
+
+// errNotHolder is returned while releasing a lock that isn't held by the given owner
+var errNotHolder = errors.New("lock is not held by this owner")
+
+// lockNames splits a comma or newline separated list of lock names, dropping any duplicates
+func lockNames(value string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("at least one lock name is required")
+	}
+	if len(names) > MaxLockNames {
+		return nil, fmt.Errorf("can't lock %d names at once, at most %d locks can be acquired in a single DynamoDB transaction", len(names), MaxLockNames)
+	}
+	return names, nil
+}
+
 func lock() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "lock",
+		Use:   CommandLock,
 		Short: "Create a lock",
 		Run: func(cmd *cobra.Command, _ []string) {
-			LockTimeout := viper.GetInt(LockTimeoutVar)
-			LockTable, _ := cmd.Flags().GetString(LockTableVar)
-			LockKeyName, _ := cmd.Flags().GetString(LockKeyNameVar)
-			LockName, _ := cmd.Flags().GetString(LockNameVar)
+			config, err := loadConfig(cmd, CommandLock)
+			if err != nil {
+				log.Printf("Invalid settings: %v", err)
+				os.Exit(ExitConfig)
+			}
+			if config.Token == "" {
+				token, err := newOwnerToken()
+				if err != nil {
+					log.Fatalf("Failed to generate owner token: %+v", err)
+				}
+				config.Token = token
+				log.Printf("Generated owner token %s", token)
+			}
 
 			log.Print("Creating lock with the following parameters:")
-			log.Printf("LockTimeout: %v", LockTimeout)
-			log.Printf("LockTable: %v", LockTable)
-			log.Printf("LockKeyName: %v", LockKeyName)
-			log.Printf("LockName: %v", LockName)
-
-			svc := dynamodb.New(session.Must(session.NewSession()))
-			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(LockTimeout)*time.Minute)
-			defer cancel()
-
-			log.Println("Acquiring lock")
-			for {
-				_, err := svc.PutItem(&dynamodb.PutItemInput{
-					TableName: aws.String(LockTable),
-					Item: map[string]*dynamodb.AttributeValue{
-						LockKeyName: {
-							S: aws.String(LockName),
-						},
-					},
-					ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%s)", LockKeyName)),
-				})
+			logSources(cmd)
 
-				if err != nil {
-					if aerr, ok := err.(awserr.Error); ok {
-						if aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
-							log.Fatalf("Failed to create lock: %+v", err)
-						}
-					}
-				} else {
-					log.Printf("Lock acquired")
-					return
+			locker, err := newLocker(config)
+			if err != nil {
+				log.Printf("Failed to set up %s backend: %+v", config.Backend, err)
+				os.Exit(ExitConfig)
+			}
+			request := config.request()
+			ctx := cmd.Context()
+			attempt, err := acquireLocks(ctx, locker, request, config.AcquireTimeout, wallClock{})
+			switch {
+			case err == context.Canceled:
+				log.Fatal("Cancelled while waiting to acquire lock")
+			case err == errLockHeld:
+				if err := setOutput(AcquiredOutput, "false"); err != nil {
+					log.Fatalf("Failed to set acquired output: %+v", err)
 				}
+				log.Print("Lock is held, giving up without waiting for it")
+				os.Exit(ExitLockHeld)
+			case err == errLockTimeout:
+				log.Print("Timed out waiting to acquire lock")
+				os.Exit(ExitNotAcquired)
+			case err != nil:
+				log.Printf("Failed to create lock, with a %s error: %+v", errorClass(err), err)
+				os.Exit(exitCode(err))
+			}
 
-				select {
-				case <-ctx.Done():
-					log.Fatal("Timed out waiting to acquire lock")
-				case <-time.After(5 * time.Second):
-					log.Print("Failed to acquire lock, trying again")
+			fence := attempt.fence()
+			owner := attempt.Owner
+			if attempt.HoldUntil != 0 {
+				log.Printf("Waiting jobs can break the lock from %s on, when its max-hold runs out", time.Unix(attempt.HoldUntil, 0).UTC().Format(time.RFC3339))
+			}
+			if err := saveState(LockTokenVar, owner); err != nil {
+				log.Fatalf("Failed to save owner token for unlock: %+v", err)
+			}
+			if err := saveState(LockHierarchicalVar, strconv.FormatBool(config.Hierarchical)); err != nil {
+				log.Fatalf("Failed to save hierarchical setting for unlock: %+v", err)
+			}
+			if ctx.Err() != nil {
+				// Don't count on the post step running when we were cancelled right as
+				// the lock was acquired
+				abandonLocks(locker, request, owner, true)
+				log.Fatal("Cancelled while acquiring lock, released it again")
+			}
+			if config.Heartbeat {
+				pid, err := startHeartbeat(config, request, attempt, config.HeartbeatPID)
+				if err != nil {
+					log.Fatalf("Failed to start heartbeat: %+v", err)
 				}
+				log.Printf("Started heartbeat as process %d", pid)
+			}
+			if err := setOutput(LockTokenVar, owner); err != nil {
+				log.Fatalf("Failed to set owner token output: %+v", err)
+			}
+			if err := setOutput(AcquiredOutput, "true"); err != nil {
+				log.Fatalf("Failed to set acquired output: %+v", err)
+			}
+			if err := setOutput(FencingTokenOutput, fence); err != nil {
+				log.Fatalf("Failed to set fencing token output: %+v", err)
+			}
+			if err := exportEnv(FencingTokenEnv, fence); err != nil {
+				log.Fatalf("Failed to export fencing token: %+v", err)
 			}
 		},
 	}
 
-	cmd.PersistentFlags().Int(LockTimeoutVar, DefaultLockTimeout, "How long to wait to acquire a lock, in minutes")
-	viper.BindPFlag(LockTimeoutVar, cmd.PersistentFlags().Lookup(LockTimeoutVar))
-
-	cmd.PersistentFlags().String(LockTableVar, DefaultLockTable, "DynamoDB table to write the lock in")
-	viper.BindPFlag(LockTableVar, cmd.PersistentFlags().Lookup(LockTableVar))
-
-	cmd.PersistentFlags().String(LockKeyNameVar, DefaultLockKeyName, "Name of the column where we write locks")
-	viper.BindPFlag(LockKeyNameVar, cmd.PersistentFlags().Lookup(LockKeyNameVar))
-
-	cmd.PersistentFlags().String(LockNameVar, DefaultLockName, "Name of the lock")
-	viper.BindPFlag(LockNameVar, cmd.PersistentFlags().Lookup(LockNameVar))
+	addSettingFlags(cmd,
+		LockBackendVar, LockTableVar, LockKeyNameVar, LockBucketVar, LockPrefixVar, LockEndpointVar,
+		LockNameVar, LockTokenVar, LockTimeoutVar, LockAcquireTimeoutVar, LockWaitVar,
+		LockBackoffVar, LockBackoffMinVar, LockBackoffMaxVar, LockBackoffMultiplierVar, LockRetryBudgetVar,
+		LockLeaseVar, LockMaxHoldVar, LockHeartbeatVar, LockHeartbeatIntervalVar, LockHeartbeatOnLostVar,
+		LockHeartbeatPIDVar, LockPermitsVar, LockModeVar, LockPriorityVar, LockReentrantVar, LockHierarchicalVar,
+	)
 	return cmd
 }
 
 func unlock() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "unlock",
+		Use:   CommandUnlock,
 		Short: "Release a lock",
 		Run: func(cmd *cobra.Command, _ []string) {
-			LockTable, _ := cmd.Flags().GetString(LockTableVar)
-			LockKeyName, _ := cmd.Flags().GetString(LockKeyNameVar)
-			LockName, _ := cmd.Flags().GetString(LockNameVar)
-
-			svc := dynamodb.New(session.Must(session.NewSession()))
-
-			log.Println("Acquiring lock to release it")
-			output, err := svc.GetItem(&dynamodb.GetItemInput{
-				TableName:      aws.String(LockTable),
-				ConsistentRead: aws.Bool(true),
-				Key: map[string]*dynamodb.AttributeValue{
-					LockKeyName: {
-						S: aws.String(LockName),
-					},
-				},
-			})
+			config, err := loadConfig(cmd, CommandUnlock)
 			if err != nil {
-				log.Fatalf("Failed to get lock during unlock process: %+v", err)
-			}
-
-			if len(output.Item) != 0 {
-				log.Print("Releasing lock")
-				_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
-					TableName: aws.String(LockTable),
-					Key: map[string]*dynamodb.AttributeValue{
-						LockKeyName: {
-							S: aws.String(LockName),
-						},
-					},
-				})
-				if err != nil {
-					log.Fatalf("Failed to delete lock: %+v", err)
-				}
+				log.Printf("Invalid settings: %v", err)
+				os.Exit(ExitConfig)
+			}
+			if config.Token == "" {
+				config.Token = getState(LockTokenVar)
+			}
+			if config.Token == "" {
+				log.Print("No owner token was found, so this job does not hold a lock to release")
+				return
+			}
+			if !config.Hierarchical {
+				config.Hierarchical = getState(LockHierarchicalVar) == "true"
 			}
-		},
-	}
 
-	cmd.PersistentFlags().String(LockTableVar, DefaultLockTable, "DynamoDB table to delete the lock from")
-	viper.BindPFlag(LockTableVar, cmd.PersistentFlags().Lookup(LockTableVar))
+			log.Print("Releasing lock with the following parameters:")
+			logSources(cmd)
 
-	cmd.PersistentFlags().String(LockKeyNameVar, DefaultLockKeyName, "Name of the column where we write locks")
-	viper.BindPFlag(LockKeyNameVar, cmd.PersistentFlags().Lookup(LockKeyNameVar))
+			locker, err := newLocker(config)
+			if err != nil {
+				log.Printf("Failed to set up %s backend: %+v", config.Backend, err)
+				os.Exit(ExitConfig)
+			}
 
-	cmd.PersistentFlags().String(LockNameVar, DefaultLockName, "Name of the lock")
-	viper.BindPFlag(LockNameVar, cmd.PersistentFlags().Lookup(LockNameVar))
+			// All of the locks that were acquired together are released together
+			err = retryContended(cmd.Context(), config.RetryBudget, wallClock{}, func() error {
+				return locker.Release(cmd.Context(), config.request(), config.Token, true)
+			})
+			if err == errNotHolder {
+				log.Print("Lock is not held by this owner, leaving it in place")
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to release lock, with a %s error: %+v", errorClass(err), err)
+				os.Exit(exitCode(err))
+			}
+			log.Print("Lock released")
+		},
+	}
 
+	addSettingFlags(cmd,
+		LockBackendVar, LockTableVar, LockKeyNameVar, LockBucketVar, LockPrefixVar, LockEndpointVar,
+		LockNameVar, LockTokenVar, LockHierarchicalVar, LockRetryBudgetVar,
+	)
 	return cmd
 }
 
+// signalContext returns a context that is cancelled once we receive SIGINT or SIGTERM,
+// so that we can clean up after ourselves. A second signal stops us right away.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v, cancelling", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "github-action-locks",
@@ -170,10 +414,25 @@ func main() {
 	viper.SetEnvPrefix("INPUT")
 	viper.AutomaticEnv()
 
-	rootCmd.Flags().String(LockTableVar, "", "DynamoDB table to write the lock in")
-	rootCmd.Flags().String(LockKeyNameVar, "", "Name of the column where we write locks")
-	rootCmd.Flags().String(LockNameVar, "", "Name of the lock")
+	// Only the flags of the command that runs are bound, so that commands sharing a
+	// setting don't read each other's flags
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, _ []string) {
+		viper.BindPFlags(cmd.Flags())
+		if err := readConfigFile(); err != nil {
+			log.Printf("Invalid config file: %v", err)
+			os.Exit(ExitConfig)
+		}
+	}
+	rootCmd.PersistentFlags().String(ConfigFileVar, "", "Config file to read settings and profiles from, defaults to "+DefaultConfigFile+" when it exists")
+	rootCmd.PersistentFlags().String(ProfileVar, "", "Profile of the config file whose settings to use")
+
 	rootCmd.AddCommand(lock())
 	rootCmd.AddCommand(unlock())
-	rootCmd.Execute()
+	rootCmd.AddCommand(heartbeat())
+	rootCmd.AddCommand(run())
+	rootCmd.AddCommand(inspect())
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	rootCmd.ExecuteContext(ctx)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// MaxLockNameLength is the longest a lock name can be, well within the 2048 bytes that
+// DynamoDB allows for a partition key
+const MaxLockNameLength = 1024
+
+var (
+	// invalidNameChars are the characters that are replaced in lock names, everything
+	// but lowercase letters, digits, dots, underscores, dashes and slashes
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9._/-]+`)
+
+	// repeatedDashes are runs of dashes left behind by replacing characters
+	repeatedDashes = regexp.MustCompile(`-{2,}`)
+)
+
+// nameContext is what lock name templates are expanded from. Every field is a single
+// segment of a lock name, so slashes in branch names and the like don't add levels to
+// hierarchical locks.
+type nameContext struct {
+	Repository     string
+	RepositoryName string
+	Owner          string
+	Workflow       string
+	Job            string
+	Ref            string
+	RefName        string
+	BaseRef        string
+	HeadRef        string
+	SHA            string
+	Actor          string
+	EventName      string
+	RunID          string
+	RunAttempt     string
+
+	// Event is the payload of the event that triggered the workflow, like
+	// {{.Event.pull_request.number}}, with every string and number in it made a
+	// single segment, see eventSegments
+	Event map[string]interface{}
+}
+
+// newNameContext reads the GitHub Actions environment variables and the event payload
+// at GITHUB_EVENT_PATH
+func newNameContext() (*nameContext, error) {
+	repository := os.Getenv("GITHUB_REPOSITORY")
+	owner, name := repository, ""
+	if i := strings.Index(repository, "/"); i >= 0 {
+		owner, name = repository[:i], repository[i+1:]
+	}
+	ref := os.Getenv("GITHUB_REF")
+	refName := os.Getenv("GITHUB_REF_NAME")
+	if refName == "" {
+		refName = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	}
+
+	c := &nameContext{
+		Repository:     nameSegment(repository),
+		RepositoryName: nameSegment(name),
+		Owner:          nameSegment(owner),
+		Workflow:       nameSegment(os.Getenv("GITHUB_WORKFLOW")),
+		Job:            nameSegment(os.Getenv("GITHUB_JOB")),
+		Ref:            nameSegment(ref),
+		RefName:        nameSegment(refName),
+		BaseRef:        nameSegment(os.Getenv("GITHUB_BASE_REF")),
+		HeadRef:        nameSegment(os.Getenv("GITHUB_HEAD_REF")),
+		SHA:            nameSegment(os.Getenv("GITHUB_SHA")),
+		Actor:          nameSegment(os.Getenv("GITHUB_ACTOR")),
+		EventName:      nameSegment(os.Getenv("GITHUB_EVENT_NAME")),
+		RunID:          nameSegment(os.Getenv("GITHUB_RUN_ID")),
+		RunAttempt:     nameSegment(os.Getenv("GITHUB_RUN_ATTEMPT")),
+		Event:          map[string]interface{}{},
+	}
+
+	if path := os.Getenv("GITHUB_EVENT_PATH"); path != "" {
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read event payload: %v", err)
+		}
+		// Numbers are kept as they're written, so that large ones like IDs don't turn
+		// into floats like 1.234e+09
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		var event map[string]interface{}
+		if err := decoder.Decode(&event); err != nil {
+			return nil, fmt.Errorf("failed to parse event payload %s: %v", path, err)
+		}
+		c.Event = eventSegments(event).(map[string]interface{})
+	}
+	return c, nil
+}
+
+// eventSegments turns every string and number in a value of the event payload into a
+// single segment of a lock name, so that a title with slashes, commas or newlines in
+// it can't add levels to a lock or split it into several locks
+func eventSegments(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, v := range value {
+			value[key] = eventSegments(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = eventSegments(v)
+		}
+	case string:
+		return nameSegment(value)
+	case json.Number:
+		return nameSegment(value.String())
+	}
+	return value
+}
+
+// Env is the value of an environment variable as a single segment of a lock name, like
+// {{.Env "DEPLOY_ENV"}}. Variables that aren't set are an error rather than an empty
+// segment, so that a typo doesn't turn into a lock that every job shares.
+func (c *nameContext) Env(name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return nameSegment(value), nil
+}
+
+// nameSegment normalizes value into a single segment of a lock name
+func nameSegment(value string) string {
+	return normalizeLockName(strings.Replace(value, "/", "-", -1))
+}
+
+// normalizeLockName lowercases a lock name and replaces the characters that aren't
+// allowed in it with dashes, so that names expanded from templates look the same
+// across repositories, whatever the case and spelling of their branches and workflows
+func normalizeLockName(name string) string {
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	name = repeatedDashes.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-")
+}
+
+// expandLockNames expands the templates in a comma or newline separated list of lock
+// names, and normalizes and validates the names that came out of them. Names without
+// templates are left as they are, so that locks that already exist keep their names.
+func expandLockNames(value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %v", err)
+	}
+	context, err := newNameContext()
+	if err != nil {
+		return "", err
+	}
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, context); err != nil {
+		return "", fmt.Errorf("failed to expand template: %v", err)
+	}
+
+	var names []string
+	for _, name := range strings.FieldsFunc(expanded.String(), func(r rune) bool { return r == ',' || r == '\n' }) {
+		name = normalizeLockName(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if err := validateLockName(name); err != nil {
+			return "", fmt.Errorf("template expanded to invalid name %q: %v", name, err)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ","), nil
+}
+
+// validateLockName checks a lock name that was expanded from a template
+func validateLockName(name string) error {
+	if len(name) > MaxLockNameLength {
+		return fmt.Errorf("names can be at most %d characters long", MaxLockNameLength)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" {
+			return errors.New("it has an empty segment, was a value of the template empty?")
+		}
+	}
+	return nil
+}
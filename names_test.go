@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestNameSegment(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"main", "main"},
+		{"feature/login", "feature-login"},
+		{"refs/heads/Feature/Login", "refs-heads-feature-login"},
+		{"My Repo", "my-repo"},
+		{"--a//b--", "a-b"},
+		{"Fix a/b, c\nd", "fix-a-b-c-d"},
+		{"v1.2.3_rc", "v1.2.3_rc"},
+	}
+	for _, test := range tests {
+		if got := nameSegment(test.value); got != test.expected {
+			t.Errorf("nameSegment(%q) = %q, expected %q", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestNormalizeLockName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Prod/US-East-1/Network", "prod/us-east-1/network"},
+		{"deploy prod", "deploy-prod"},
+		{"  deploy  ", "deploy"},
+		{"a!!b", "a-b"},
+	}
+	for _, test := range tests {
+		if got := normalizeLockName(test.name); got != test.expected {
+			t.Errorf("normalizeLockName(%q) = %q, expected %q", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestEventSegments(t *testing.T) {
+	event := map[string]interface{}{
+		"title":  "Fix A/B",
+		"draft":  false,
+		"labels": []interface{}{"X/Y", map[string]interface{}{"name": "Needs Review"}},
+	}
+	got := eventSegments(event).(map[string]interface{})
+	if got["title"] != "fix-a-b" {
+		t.Errorf("expected title fix-a-b, got %v", got["title"])
+	}
+	if got["draft"] != false {
+		t.Errorf("expected draft to stay false, got %v", got["draft"])
+	}
+	labels := got["labels"].([]interface{})
+	if labels[0] != "x-y" || labels[1].(map[string]interface{})["name"] != "needs-review" {
+		t.Errorf("expected the labels to be segments, got %v", labels)
+	}
+}
+
+func TestExpandLockNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	eventPath := filepath.Join(dir, "event.json")
+	payload := `{"pull_request": {"id": 1234567890123456789, "number": 42, "title": "Fix a/b, c"}, "empty": ""}`
+	if err := ioutil.WriteFile(eventPath, []byte(payload), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "GITHUB_EVENT_PATH", eventPath)
+	setenv(t, "GITHUB_REPOSITORY", "Abatilo/My-Repo")
+	setenv(t, "GITHUB_REF", "refs/heads/Feature/Login")
+	setenv(t, "GITHUB_REF_NAME", "")
+	setenv(t, "GITHUB_WORKFLOW", "Deploy Prod")
+	setenv(t, "DEPLOY_ENV", "Staging/EU")
+	os.Unsetenv("MISSING_VARIABLE")
+
+	tests := []struct {
+		value    string
+		expected string
+		fails    bool
+	}{
+		{value: "Deploy/Prod", expected: "Deploy/Prod"},
+		{value: "{{.Repository}}/{{.RefName}}", expected: "abatilo-my-repo/feature-login"},
+		{value: "{{.Owner}}/{{.RepositoryName}}/{{.Workflow}}", expected: "abatilo/my-repo/deploy-prod"},
+		{value: "env/{{.Env \"DEPLOY_ENV\"}}", expected: "env/staging-eu"},
+		{value: "pr/{{.Event.pull_request.id}}", expected: "pr/1234567890123456789"},
+		{value: "pr/{{.Event.pull_request.number}},title/{{.Event.pull_request.title}}", expected: "pr/42,title/fix-a-b-c"},
+		{value: "pr/{{.Event.empty}}/deploy", fails: true},
+		{value: "{{.Repository}}//{{.RefName}}", fails: true},
+		{value: "env/{{.Env \"MISSING_VARIABLE\"}}", fails: true},
+		{value: "{{.Event.missing.field}}", fails: true},
+		{value: "{{.Missing}}", fails: true},
+		{value: "{{.Repository", fails: true},
+	}
+	for _, test := range tests {
+		got, err := expandLockNames(test.value)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("expandLockNames(%q) = %q, expected an error", test.value, got)
+		case !test.fails && err != nil:
+			t.Errorf("expandLockNames(%q) failed: %v", test.value, err)
+		case got != test.expected:
+			t.Errorf("expandLockNames(%q) = %q, expected %q", test.value, got, test.expected)
+		}
+	}
+}
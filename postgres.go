@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// BackendPostgres keeps every lock in a row of a Postgres table
+	BackendPostgres = "postgres"
+
+	// DefaultAdvisoryInterval is how often run checks that it still holds its advisory
+	// locks when there's no lease to derive the heartbeat-interval from
+	DefaultAdvisoryInterval = 10 * time.Second
+)
+
+func init() {
+	registerBackend(BackendPostgres, func(config *lockConfig) (Locker, error) {
+		// A row only has room for a single owner
+		if err := requireSingleOwner(config, BackendPostgres); err != nil {
+			return nil, err
+		}
+
+		// Without an endpoint, the connection is set up from the PG environment
+		// variables like PGHOST and PGDATABASE
+		db, err := sql.Open("postgres", config.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		locker := &postgresLocker{db: db, table: pq.QuoteIdentifier(config.Table)}
+		if config.Advisory {
+			return &postgresAdvisoryLocker{postgresLocker: locker}, nil
+		}
+		return locker, nil
+	})
+}
+
+// postgresLocker keeps every lock in a row of table, with the token of its owner, when
+// its lease runs out and its fencing token. Rows are never deleted, so that their
+// fencing tokens keep counting up.
+type postgresLocker struct {
+	db    *sql.DB
+	table string
+
+	created bool
+}
+
+// createTable creates the table of the locks, unless it exists already. Whether it
+// exists is looked up first, since CREATE TABLE IF NOT EXISTS needs the CREATE
+// privilege on the schema even when the table is there, which jobs that only use
+// the table don't need to have.
+func (l *postgresLocker) createTable(ctx context.Context) error {
+	if l.created {
+		return nil
+	}
+	var exists bool
+	if err := l.db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, l.table).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		l.created = true
+		return nil
+	}
+	_, err := l.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+l.table+` (
+		name text PRIMARY KEY,
+		owner text,
+		expires_at timestamptz,
+		fence bigint NOT NULL DEFAULT 0,
+		acquired_at timestamptz
+	)`)
+	if perr, ok := err.(*pq.Error); ok && perr.Code == "23505" {
+		// Someone else created the table at the same time
+		err = nil
+	}
+	l.created = err == nil
+	return err
+}
+
+// postgresLease is the expiry of a lock with a lease of $3 milliseconds, on the clock
+// of the database. A lease of 0 never expires.
+const postgresLease = `CASE WHEN $3::bigint = 0 THEN NULL ELSE now() + $3::double precision * interval '1 millisecond' END`
+
+func (l *postgresLocker) Acquire(ctx context.Context, request *lockRequest, now time.Time) (*lockAttempt, error) {
+	if err := l.createTable(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Rows are taken in the same order by everyone, so that two jobs acquiring the
+	// same locks can't deadlock
+	names := append([]string(nil), request.Names...)
+	sort.Strings(names)
+	fences := map[string]int64{}
+	attempt := &lockAttempt{Owner: request.Token}
+	for _, name := range names {
+		// A lock is taken over when nobody holds it or the lease of its holder ran out
+		var fence int64
+		err := tx.QueryRowContext(ctx, `INSERT INTO `+l.table+` AS existing (name, owner, expires_at, fence, acquired_at)
+			VALUES ($1, $2, `+postgresLease+`, 1, now())
+			ON CONFLICT (name) DO UPDATE SET
+				owner = EXCLUDED.owner,
+				expires_at = EXCLUDED.expires_at,
+				fence = existing.fence + 1,
+				acquired_at = EXCLUDED.acquired_at
+			WHERE existing.owner IS NULL OR existing.expires_at < now()
+			RETURNING fence`, name, request.Token, request.Lease.Milliseconds()).Scan(&fence)
+		if err == nil {
+			fences[name] = fence
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		// The lock is held, possibly by us when an earlier attempt went through
+		// after all
+		var owner sql.NullString
+		if err := tx.QueryRowContext(ctx, `SELECT owner, fence FROM `+l.table+` WHERE name = $1`, name).Scan(&owner, &fence); err != nil {
+			return nil, err
+		}
+		if owner.String == request.Token {
+			fences[name] = fence
+			continue
+		}
+		attempt.Waiting = append(attempt.Waiting, fmt.Sprintf("%s, held by owner %s", name, owner.String))
+	}
+	if len(attempt.Waiting) > 0 {
+		return attempt, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	attempt.Acquired = true
+	for _, name := range request.Names {
+		attempt.Fences = append(attempt.Fences, fences[name])
+	}
+	return attempt, nil
+}
+
+func (l *postgresLocker) Release(ctx context.Context, request *lockRequest, owner string, holds bool) error {
+	// Nobody waits in line, so there's nothing to give up but holds
+	if !holds {
+		return errNotHolder
+	}
+	if err := l.createTable(ctx); err != nil {
+		return err
+	}
+	result, err := l.db.ExecContext(ctx, `UPDATE `+l.table+` SET owner = NULL, expires_at = NULL
+		WHERE name = ANY($1) AND owner = $2`, pq.Array(request.Names), owner)
+	if err != nil {
+		return err
+	}
+	if released, err := result.RowsAffected(); err != nil || released == 0 {
+		if err != nil {
+			return err
+		}
+		return errNotHolder
+	}
+	return nil
+}
+
+func (l *postgresLocker) Renew(ctx context.Context, request *lockRequest, owner string, now time.Time) (int64, error) {
+	if err := l.createTable(ctx); err != nil {
+		return 0, err
+	}
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// $1 and $2 are the names and owner, and $3 is the lease like when acquiring
+	result, err := tx.ExecContext(ctx, `UPDATE `+l.table+` SET expires_at = `+postgresLease+`
+		WHERE name = ANY($1) AND owner = $2 AND (expires_at IS NULL OR expires_at >= now())`,
+		pq.Array(request.Names), owner, request.Lease.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	renewed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if renewed != int64(len(request.Names)) {
+		return 0, errNotHolder
+	}
+	return now.Add(request.Lease).Unix(), tx.Commit()
+}
+
+func (l *postgresLocker) Inspect(ctx context.Context, names []string) (map[string]*lockState, error) {
+	if err := l.createTable(ctx); err != nil {
+		return nil, err
+	}
+	states := map[string]*lockState{}
+	for _, name := range names {
+		states[name] = &lockState{}
+	}
+	rows, err := l.db.QueryContext(ctx, `SELECT name, owner, extract(epoch FROM expires_at)::bigint, fence, acquired_at
+		FROM `+l.table+` WHERE name = ANY($1)`, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var owner sql.NullString
+		var expiresAt sql.NullInt64
+		var acquiredAt pq.NullTime
+		state := &lockState{}
+		if err := rows.Scan(&name, &owner, &expiresAt, &state.Fence, &acquiredAt); err != nil {
+			return nil, err
+		}
+		if owner.Valid {
+			holder := &lockHolder{Mode: ModeExclusive, Fence: state.Fence, ExpiresAt: expiresAt.Int64}
+			if acquiredAt.Valid {
+				holder.AcquiredAt = acquiredAt.Time.UTC().Format(time.RFC3339)
+			}
+			state.Holders = map[string]*lockHolder{owner.String: holder}
+		}
+		states[name] = state
+	}
+	return states, rows.Err()
+}
+
+// postgresAdvisoryLocker holds session advisory locks on a connection of its own, which
+// Postgres releases by itself once the session ends, however the process ends. It can
+// only be used by run, since the locks are gone once the process that took them exits.
+// Fencing tokens still count up in the table, but the owner column is left alone, so
+// advisory locks don't exclude the locks of the table and the two shouldn't be mixed.
+type postgresAdvisoryLocker struct {
+	*postgresLocker
+
+	conn *sql.Conn
+}
+
+// advisoryKey is the key of the advisory lock of a lock name, which is hashed along
+// with the table so that locks of different tables don't collide
+func (l *postgresAdvisoryLocker) advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(l.table + "/" + name))
+	return int64(h.Sum64())
+}
+
+func (l *postgresAdvisoryLocker) Acquire(ctx context.Context, request *lockRequest, now time.Time) (*lockAttempt, error) {
+	if err := l.createTable(ctx); err != nil {
+		return nil, err
+	}
+	// The connection is kept from one attempt to the next, and for as long as the
+	// locks are held
+	if l.conn == nil {
+		conn, err := l.db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = conn
+	}
+
+	attempt := &lockAttempt{Owner: request.Token}
+	var locked []string
+	for _, name := range request.Names {
+		var ok bool
+		if err := l.conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, l.advisoryKey(name)).Scan(&ok); err != nil {
+			l.disconnect()
+			return nil, err
+		}
+		if !ok {
+			attempt.Waiting = append(attempt.Waiting, fmt.Sprintf("%s, held by another session", name))
+			continue
+		}
+		locked = append(locked, name)
+	}
+	if len(attempt.Waiting) > 0 {
+		l.unlock(ctx, locked)
+		return attempt, nil
+	}
+
+	for _, name := range request.Names {
+		var fence int64
+		err := l.conn.QueryRowContext(ctx, `INSERT INTO `+l.table+` AS existing (name, fence, acquired_at)
+			VALUES ($1, 1, now())
+			ON CONFLICT (name) DO UPDATE SET fence = existing.fence + 1, acquired_at = EXCLUDED.acquired_at
+			RETURNING fence`, name).Scan(&fence)
+		if err != nil {
+			l.disconnect()
+			return nil, err
+		}
+		attempt.Fences = append(attempt.Fences, fence)
+	}
+	attempt.Acquired = true
+	return attempt, nil
+}
+
+// unlock releases the advisory locks of names that the session holds, and returns how
+// many it released
+func (l *postgresAdvisoryLocker) unlock(ctx context.Context, names []string) int {
+	unlocked := 0
+	for _, name := range names {
+		var ok bool
+		if err := l.conn.QueryRowContext(ctx, `SELECT pg_advisory_unlock($1)`, l.advisoryKey(name)).Scan(&ok); err == nil && ok {
+			unlocked++
+		}
+	}
+	return unlocked
+}
+
+// disconnect ends the session, which releases all of its advisory locks
+func (l *postgresAdvisoryLocker) disconnect() {
+	if l.conn != nil {
+		l.conn.Raw(func(driverConn interface{}) error { return driver.ErrBadConn })
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
+func (l *postgresAdvisoryLocker) Release(ctx context.Context, request *lockRequest, owner string, holds bool) error {
+	if !holds || l.conn == nil {
+		return errNotHolder
+	}
+	unlocked := l.unlock(ctx, request.Names)
+	l.disconnect()
+	if unlocked == 0 {
+		return errNotHolder
+	}
+	return nil
+}
+
+// Renew checks that the session still holds the advisory locks. They're held for as
+// long as the session lasts and no longer, so there's no deadline to report, and any
+// failure to check them means they're lost.
+func (l *postgresAdvisoryLocker) Renew(ctx context.Context, request *lockRequest, owner string, now time.Time) (int64, error) {
+	if l.conn == nil {
+		return 0, errNotHolder
+	}
+	keys := make([]int64, len(request.Names))
+	for i, name := range request.Names {
+		keys[i] = l.advisoryKey(name)
+	}
+	// A bigint key is split over the classid and objid columns
+	var held int
+	err := l.conn.QueryRowContext(ctx, `SELECT count(*) FROM pg_locks
+		WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted AND objsubid = 1
+		AND ((classid::bigint << 32) | objid::bigint) = ANY($1)`, pq.Array(keys)).Scan(&held)
+	if err != nil && ctx.Err() != nil {
+		return 0, err
+	}
+	if err != nil || held < len(request.Names) {
+		return 0, errNotHolder
+	}
+	return 0, nil
+}
+
+// postgresErrorClass sorts errors that were returned by the Postgres server by the
+// class of their SQLSTATE code
+func postgresErrorClass(err *pq.Error) string {
+	switch {
+	case err.Code.Class() == "28", err.Code == "3D000", err.Code == "42501":
+		// Invalid authorization, a database that doesn't exist, or missing privileges
+		return ErrorConfig
+	case err.Code.Class() == "08", err.Code.Class() == "40", err.Code.Class() == "53", err.Code == "57P03":
+		// Connection failures, serialization failures and deadlocks, running out of
+		// resources, or a server that is starting up
+		return ErrorRetryable
+	}
+	return ErrorFatal
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// BackendRedis keeps every lock in a key of a Redis server, which expires along
+	// with the lease
+	BackendRedis = "redis"
+
+	// DefaultRedisEndpoint is the Redis server that's used when there's no endpoint
+	DefaultRedisEndpoint = "redis://localhost:6379"
+
+	// RedisTimeout is how long to wait for the Redis server to connect, or to answer
+	RedisTimeout = 10 * time.Second
+)
+
+// redisAcquire sets every lock in KEYS[1..n] to the owner token in ARGV[1], with a
+// lease of ARGV[2] milliseconds unless that's 0, as long as none of them is held by
+// anyone else. Every lock that was set increments its fencing token in KEYS[n+1..2n].
+// It returns 1 and the fencing tokens, or 0 and the owner of the first lock that's
+// held. Locks that are already held by the owner, because an earlier attempt went
+// through after all, keep their fencing token.
+var redisAcquire = `
+local n = #KEYS / 2
+for i = 1, n do
+	local owner = redis.call('GET', KEYS[i])
+	if owner and owner ~= ARGV[1] then
+		return {0, owner}
+	end
+end
+local result = {1}
+for i = 1, n do
+	if redis.call('GET', KEYS[i]) == ARGV[1] then
+		table.insert(result, redis.call('GET', KEYS[n + i]) or '0')
+	else
+		if ARGV[2] == '0' then
+			redis.call('SET', KEYS[i], ARGV[1], 'NX')
+		else
+			redis.call('SET', KEYS[i], ARGV[1], 'NX', 'PX', ARGV[2])
+		end
+		table.insert(result, tostring(redis.call('INCR', KEYS[n + i])))
+	end
+end
+return result
+`
+
+// redisRelease deletes every lock in KEYS that is held by the owner token in ARGV[1],
+// and returns how many it deleted
+var redisRelease = `
+local released = 0
+for i = 1, #KEYS do
+	if redis.call('GET', KEYS[i]) == ARGV[1] then
+		redis.call('DEL', KEYS[i])
+		released = released + 1
+	end
+end
+return released
+`
+
+// redisRenew sets the lease of every lock in KEYS to ARGV[2] milliseconds, as long as
+// all of them are held by the owner token in ARGV[1]. It returns 1, or 0 without
+// renewing any of them when one isn't held by the owner anymore.
+var redisRenew = `
+for i = 1, #KEYS do
+	if redis.call('GET', KEYS[i]) ~= ARGV[1] then
+		return 0
+	end
+end
+for i = 1, #KEYS do
+	redis.call('PEXPIRE', KEYS[i], ARGV[2])
+end
+return 1
+`
+
+func init() {
+	registerBackend(BackendRedis, func(config *lockConfig) (Locker, error) {
+		// A key only has room for a single owner
+		if err := requireSingleOwner(config, BackendRedis); err != nil {
+			return nil, err
+		}
+
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultRedisEndpoint
+		}
+		return &redisLocker{
+			endpoint: endpoint,
+			prefix:   config.Prefix,
+			acquire:  redis.NewScript(-1, redisAcquire),
+			release:  redis.NewScript(-1, redisRelease),
+			renew:    redis.NewScript(-1, redisRenew),
+		}, nil
+	})
+}
+
+// redisLocker keeps every lock in a key named after the lock under prefix, holding the
+// token of its owner, and its fencing token in a key next to it that's never deleted
+type redisLocker struct {
+	endpoint string
+	prefix   string
+	acquire  *redis.Script
+	release  *redis.Script
+	renew    *redis.Script
+}
+
+// keys returns the keys of the locks followed by the keys of their fencing tokens
+func (l *redisLocker) keys(names []string, fences bool) []interface{} {
+	var keys []interface{}
+	for _, name := range names {
+		keys = append(keys, l.prefix+name)
+	}
+	if fences {
+		for _, name := range names {
+			keys = append(keys, l.prefix+name+":fence")
+		}
+	}
+	return keys
+}
+
+// do calls f with a connection to the Redis server, which is closed once ctx is done
+func (l *redisLocker) do(ctx context.Context, f func(redis.Conn) error) error {
+	conn, err := redis.DialURL(l.endpoint,
+		redis.DialConnectTimeout(RedisTimeout),
+		redis.DialReadTimeout(RedisTimeout),
+		redis.DialWriteTimeout(RedisTimeout),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err = f(conn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// script runs a script with the keys as KEYS and args as ARGV
+func script(conn redis.Conn, s *redis.Script, keys []interface{}, args ...interface{}) (interface{}, error) {
+	return s.Do(conn, append([]interface{}{len(keys)}, append(keys, args...)...)...)
+}
+
+func (l *redisLocker) Acquire(ctx context.Context, request *lockRequest, now time.Time) (*lockAttempt, error) {
+	var reply []interface{}
+	err := l.do(ctx, func(conn redis.Conn) error {
+		var err error
+		reply, err = redis.Values(script(conn, l.acquire, l.keys(request.Names, true), request.Token, request.Lease.Milliseconds()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attempt := &lockAttempt{Owner: request.Token}
+	if acquired, _ := redis.Int(reply[0], nil); acquired == 0 {
+		owner, _ := redis.String(reply[1], nil)
+		for _, name := range request.Names {
+			attempt.Waiting = append(attempt.Waiting, fmt.Sprintf("%s, held by owner %s", name, owner))
+		}
+		return attempt, nil
+	}
+	attempt.Acquired = true
+	for _, value := range reply[1:] {
+		fence, err := redis.Int64(value, nil)
+		if err != nil {
+			return nil, err
+		}
+		attempt.Fences = append(attempt.Fences, fence)
+	}
+	return attempt, nil
+}
+
+func (l *redisLocker) Release(ctx context.Context, request *lockRequest, owner string, holds bool) error {
+	// Nobody waits in line, so there's nothing to give up but holds
+	if !holds {
+		return errNotHolder
+	}
+	var released int
+	err := l.do(ctx, func(conn redis.Conn) error {
+		var err error
+		released, err = redis.Int(script(conn, l.release, l.keys(request.Names, false), owner))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if released == 0 {
+		return errNotHolder
+	}
+	return nil
+}
+
+func (l *redisLocker) Renew(ctx context.Context, request *lockRequest, owner string, now time.Time) (int64, error) {
+	var renewed int
+	err := l.do(ctx, func(conn redis.Conn) error {
+		var err error
+		renewed, err = redis.Int(script(conn, l.renew, l.keys(request.Names, false), owner, request.Lease.Milliseconds()))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if renewed == 0 {
+		return 0, errNotHolder
+	}
+	return now.Add(request.Lease).Unix(), nil
+}
+
+func (l *redisLocker) Inspect(ctx context.Context, names []string) (map[string]*lockState, error) {
+	states := map[string]*lockState{}
+	err := l.do(ctx, func(conn redis.Conn) error {
+		for _, name := range names {
+			key := l.prefix + name
+			conn.Send("MULTI")
+			conn.Send("GET", key)
+			conn.Send("PTTL", key)
+			conn.Send("GET", key+":fence")
+			reply, err := redis.Values(conn.Do("EXEC"))
+			if err != nil {
+				return err
+			}
+
+			state := &lockState{}
+			state.Fence, _ = redis.Int64(reply[2], nil)
+			if owner, err := redis.String(reply[0], nil); err == nil {
+				holder := &lockHolder{Mode: ModeExclusive, Fence: state.Fence}
+				if ttl, _ := redis.Int64(reply[1], nil); ttl > 0 {
+					holder.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Millisecond).Unix()
+				}
+				state.Holders = map[string]*lockHolder{owner: holder}
+			}
+			states[name] = state
+		}
+		return nil
+	})
+	return states, err
+}
+
+// redisErrorClass sorts errors that were returned by the Redis server by their code,
+// which is the first word of the error
+func redisErrorClass(err redis.Error) string {
+	switch strings.SplitN(string(err), " ", 2)[0] {
+	case "NOAUTH", "WRONGPASS", "NOPERM":
+		return ErrorConfig
+	case "LOADING", "BUSY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN":
+		return ErrorRetryable
+	}
+	return ErrorFatal
+}
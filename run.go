@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// runChild runs the command with its standard streams connected to ours, forwarding
+// the signals we receive to it, and returns its exit code. The command is terminated
+// once lost is closed.
+func runChild(child *exec.Cmd, lost <-chan struct{}) int {
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := child.Start(); err != nil {
+		log.Printf("Failed to start %s: %+v", child.Path, err)
+		return 1
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				log.Printf("Forwarding %v to process %d", sig, child.Process.Pid)
+				child.Process.Signal(sig)
+			case <-lost:
+				log.Printf("Terminating process %d that was protected by the lock", child.Process.Pid)
+				if err := child.Process.Signal(syscall.SIGTERM); err != nil {
+					log.Printf("Failed to terminate process %d: %+v", child.Process.Pid, err)
+				}
+				lost = nil
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := child.Wait()
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// Like a shell, report a child that was killed by a signal as 128 plus the signal
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	log.Printf("Failed to wait for %s: %+v", child.Path, err)
+	return 1
+}
+
+func run() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   CommandRun + " [flags] -- command [args...]",
+		Short: "Run a command while holding a lock",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := loadConfig(cmd, CommandRun)
+			if err != nil {
+				log.Printf("Invalid settings: %v", err)
+				os.Exit(ExitConfig)
+			}
+			if config.Token == "" {
+				token, err := newOwnerToken()
+				if err != nil {
+					log.Fatalf("Failed to generate owner token: %+v", err)
+				}
+				config.Token = token
+				log.Printf("Generated owner token %s", token)
+			}
+
+			log.Print("Running command while holding lock with the following parameters:")
+			logSources(cmd)
+
+			locker, err := newLocker(config)
+			if err != nil {
+				log.Printf("Failed to set up %s backend: %+v", config.Backend, err)
+				os.Exit(ExitConfig)
+			}
+			request := config.request()
+			attempt, err := acquireLocks(cmd.Context(), locker, request, config.AcquireTimeout, wallClock{})
+			switch {
+			case err == context.Canceled:
+				log.Fatal("Cancelled while waiting to acquire lock")
+			case err == errLockHeld:
+				log.Print("Lock is held, not running the command")
+				os.Exit(ExitLockHeld)
+			case err == errLockTimeout:
+				log.Print("Timed out waiting to acquire lock, not running the command")
+				os.Exit(ExitNotAcquired)
+			case err != nil:
+				log.Printf("Failed to create lock, with a %s error: %+v", errorClass(err), err)
+				os.Exit(exitCode(err))
+			}
+
+			child := exec.Command(args[0], args[1:]...)
+			child.Env = append(os.Environ(), FencingTokenEnv+"="+attempt.fence())
+
+			// The lease is renewed for as long as the command runs, even while it's
+			// handling a signal we forwarded, and the command is stopped when the lock
+			// is lost if on-lost is kill
+			renewCtx, stopRenewing := context.WithCancel(context.Background())
+			go warnMaxHold(renewCtx, config.Name, attempt.HoldUntil)
+			lost := make(chan struct{})
+			renewed := make(chan struct{})
+			go func() {
+				defer close(renewed)
+				// Advisory locks don't expire, but are checked on all the same, since
+				// they're lost along with the connection
+				if config.Lease == 0 && !config.Advisory {
+					return
+				}
+				err := keepRenewing(renewCtx, locker, request, attempt.Owner, config.HeartbeatInterval)
+				if err != errLockLost {
+					return
+				}
+				log.Printf("::error::LOST LOCK %s: %v", config.Name, err)
+				if config.HeartbeatOnLost == OnLostKill {
+					close(lost)
+				}
+			}()
+
+			code := runChild(child, lost)
+			stopRenewing()
+			<-renewed
+
+			// The lock is released even when we were cancelled
+			log.Print("Releasing lock")
+			err = retryContended(context.Background(), config.RetryBudget, wallClock{}, func() error {
+				return locker.Release(context.Background(), request, attempt.Owner, true)
+			})
+			switch {
+			case err == errNotHolder:
+				log.Print("Lock is not held by this owner anymore, leaving it in place")
+			case err != nil:
+				log.Printf("Failed to release lock: %+v", err)
+			default:
+				log.Print("Lock released")
+			}
+			os.Exit(code)
+		},
+	}
+
+	addSettingFlags(cmd,
+		LockBackendVar, LockTableVar, LockKeyNameVar, LockBucketVar, LockPrefixVar, LockEndpointVar, LockNameVar,
+		LockAcquireTimeoutVar, LockWaitVar,
+		LockBackoffVar, LockBackoffMinVar, LockBackoffMaxVar, LockBackoffMultiplierVar, LockRetryBudgetVar,
+		LockLeaseVar, LockMaxHoldVar, LockHeartbeatIntervalVar, LockHeartbeatOnLostVar,
+		LockPermitsVar, LockModeVar, LockPriorityVar, LockHierarchicalVar, LockAdvisoryVar,
+	)
+	return cmd
+}
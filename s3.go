@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BackendS3 keeps every lock in an object of an S3 bucket, written with conditional
+// writes
+const BackendS3 = "s3"
+
+func init() {
+	registerBackend(BackendS3, func(config *lockConfig) (Locker, error) {
+		if config.Bucket == "" {
+			return nil, fmt.Errorf("the %s backend needs a %s", BackendS3, LockBucketVar)
+		}
+		// Objects are written one at a time, so there's no way to write several
+		// locks all or nothing
+		if items := lockItems(config.Names, config.Hierarchical); len(items) > 1 {
+			return nil, fmt.Errorf("the %s backend can only acquire a single lock at a time, which rules out several names or hierarchical names below the top, got %d locks", BackendS3, len(items))
+		}
+
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		cfg := aws.NewConfig()
+		if config.Endpoint != "" {
+			// S3 compatible servers like MinIO don't have a domain for every bucket
+			cfg = cfg.WithEndpoint(config.Endpoint).WithS3ForcePathStyle(true)
+		}
+		return &storeLocker{clock: wallClock{}, store: &s3Store{
+			svc:    s3.New(sess, cfg),
+			bucket: config.Bucket,
+			prefix: config.Prefix,
+		}}, nil
+	})
+}
+
+// s3Store keeps the state of every lock in an object of bucket, named after the lock
+// under prefix. Every write is conditioned on the ETag of the object as it was read,
+// or on there being no object yet, so that concurrent writers can't overwrite each
+// other's changes.
+type s3Store struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+// s3Object is the state of a lock along with the ETag of the object it was read from,
+// which is empty when there is no object yet
+type s3Object struct {
+	state *lockState
+	etag  string
+}
+
+func (s *s3Store) loadLocks(ctx context.Context, names []string) (map[string]*lockState, error) {
+	states := map[string]*lockState{}
+	for _, name := range names {
+		object, err := s.get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		states[name] = object.state
+	}
+	return states, nil
+}
+
+func (s *s3Store) updateLocks(ctx context.Context, names []string, change func(map[string]*lockState) error) error {
+	objects := map[string]*s3Object{}
+	states := map[string]*lockState{}
+	for _, name := range names {
+		object, err := s.get(ctx, name)
+		if err != nil {
+			return err
+		}
+		objects[name] = object
+		states[name] = object.state
+	}
+	if err := change(states); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.put(ctx, name, objects[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get reads the object of a lock. A lock that was never written has an empty state.
+func (s *s3Store) get(ctx context.Context, name string) (*s3Object, error) {
+	output, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return &s3Object{state: &lockState{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	object := &s3Object{state: &lockState{}, etag: aws.StringValue(output.ETag)}
+	if err := json.Unmarshal(body, object.state); err != nil {
+		return nil, fmt.Errorf("failed to parse lock %s: %v", name, err)
+	}
+	return object, nil
+}
+
+// put writes the object of a lock, as long as it wasn't written since it was read.
+// An object that only ever held a place in line is deleted once nobody waits for it
+// anymore, but any other object is kept, so that its fencing token keeps counting up
+// from where it was.
+func (s *s3Store) put(ctx context.Context, name string, object *s3Object) error {
+	state := object.state
+	idle := len(state.Holders) == 0 && len(state.Queue) == 0 && len(state.Intents) == 0 && len(state.Below) == 0 && state.Fence == 0
+
+	var req *request.Request
+	switch {
+	case idle && object.etag == "":
+		return nil
+	case idle:
+		req, _ = s.svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.prefix + name),
+		})
+	default:
+		next := *state
+		next.Version++
+		next.ExpiresAt = next.expiry()
+		body, err := json.Marshal(&next)
+		if err != nil {
+			return err
+		}
+		req, _ = s.svc.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(s.prefix + name),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+	}
+
+	// This version of the SDK predates conditional writes, so the conditions are set
+	// on the request directly
+	if object.etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", object.etag)
+	}
+	req.SetContext(ctx)
+	err := req.Send()
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		// Someone else deleted the object since we read it
+		return errVersionConflict
+	}
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		switch failure.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			// Someone else wrote the object first, or was writing it at the same time
+			return errVersionConflict
+		}
+	}
+	return err
+}
@@ -0,0 +1,442 @@
+package main
+
+import "sort"
+
+const (
+	// ModeExclusive holders exclude shared holders, and each take up one of the lock's permits
+	ModeExclusive = "exclusive"
+
+	// ModeShared holders can hold the lock together with any number of other shared holders
+	ModeShared = "shared"
+)
+
+// lockHolder describes one owner of a lock and the GitHub Actions job it came from
+type lockHolder struct {
+	Repository string `dynamodbav:",omitempty"`
+	RunID      string `dynamodbav:",omitempty"`
+	RunAttempt string `dynamodbav:",omitempty"`
+	Job        string `dynamodbav:",omitempty"`
+	Actor      string `dynamodbav:",omitempty"`
+	SHA        string `dynamodbav:",omitempty"`
+
+	// AcquiredAt is when the lock was acquired, in RFC 3339 format
+	AcquiredAt string
+
+	// ExpiresAt is when the lease of this holder runs out, in epoch seconds. 0 means it never expires.
+	ExpiresAt int64 `dynamodbav:",omitempty"`
+
+	// Fence is the fencing token that was handed out to this holder
+	Fence int64
+
+	// Mode is either ModeExclusive or ModeShared
+	Mode string
+
+	// Scope identifies the owners that can re-enter this hold, see reentrancyScope.
+	// Holds that can't be re-entered have no scope.
+	Scope string `dynamodbav:",omitempty"`
+
+	// Holds is how many times the lock was entered by owners in the same scope
+	Holds int `dynamodbav:",omitempty"`
+
+	// MaxHold is the longest the holder declared it would hold the lock for, as a Go duration
+	MaxHold string `dynamodbav:",omitempty"`
+
+	// HoldUntil is when the holder exceeds its MaxHold, in epoch seconds, after which
+	// waiters can break the lock even if its lease is still being renewed. 0 means
+	// there's no maximum.
+	HoldUntil int64 `dynamodbav:",omitempty"`
+}
+
+// deadline is when the holder can be removed from the lock, because either its lease
+// ran out or it exceeded its max-hold, in epoch seconds. 0 means never.
+func (h *lockHolder) deadline() int64 {
+	if h.HoldUntil != 0 && (h.ExpiresAt == 0 || h.HoldUntil < h.ExpiresAt) {
+		return h.HoldUntil
+	}
+	return h.ExpiresAt
+}
+
+// expired reports whether the lease of the holder has run out
+func (h *lockHolder) expired(now int64) bool {
+	return h.ExpiresAt != 0 && h.ExpiresAt < now
+}
+
+// overdue reports whether the holder has held the lock for longer than its max-hold
+func (h *lockHolder) overdue(now int64) bool {
+	return h.HoldUntil != 0 && h.HoldUntil < now
+}
+
+// holds returns how many times the lock was entered by this holder
+func (h *lockHolder) holds() int {
+	if h.Holds < 1 {
+		return 1
+	}
+	return h.Holds
+}
+
+// lockTicket is a place in the queue of owners waiting for a lock
+type lockTicket struct {
+	// Seq is the position the ticket was handed out at
+	Seq int64
+
+	// Mode is the mode the waiting owner wants to hold the lock in
+	Mode string
+
+	// Priority orders the queue, tickets with a higher priority go first
+	Priority int `dynamodbav:",omitempty"`
+
+	// ExpiresAt is when the ticket is given up on unless the waiting owner refreshes
+	// it, in epoch seconds, so that owners that went away don't block the queue
+	ExpiresAt int64
+}
+
+// ahead reports whether the ticket gets its turn before other. A missing ticket is
+// at the back of the queue.
+func (t *lockTicket) ahead(other *lockTicket) bool {
+	switch {
+	case t == nil:
+		return false
+	case other == nil:
+		return true
+	case t.Priority != other.Priority:
+		return t.Priority > other.Priority
+	}
+	return t.Seq < other.Seq
+}
+
+// lockIntent marks that an owner holds locks below this one in the hierarchy
+type lockIntent struct {
+	// Mode is ModeExclusive if any of the locks below are held exclusive, or ModeShared
+	Mode string
+
+	// Count is how many of the locks below this one are held by the owner
+	Count int
+
+	// ExpiresAt is when the holds on the locks below run out, in epoch seconds. 0 means they never expire.
+	ExpiresAt int64 `dynamodbav:",omitempty"`
+}
+
+// lockState is everything that is stored on the item of a lock
+type lockState struct {
+	// Holders are everyone that currently holds the lock, keyed by owner token
+	Holders map[string]*lockHolder `dynamodbav:",omitempty"`
+
+	// Queue are the owners waiting for the lock, keyed by owner token
+	Queue map[string]*lockTicket `dynamodbav:",omitempty"`
+
+	// Tickets is the number of tickets ever handed out, used to number the next one
+	Tickets int64
+
+	// Intents are the owners of hierarchical locks below this one, keyed by owner token
+	Intents map[string]*lockIntent `dynamodbav:",omitempty"`
+
+	// Below are the owners waiting for hierarchical locks below this one, keyed by
+	// owner token. Their tickets are numbered along with the ones in Queue, so that
+	// owners waiting at different levels are served in the order they asked.
+	Below map[string]*lockTicket `dynamodbav:",omitempty"`
+
+	// Fence is the number of times the lock has been acquired. It's never reset, so
+	// every acquisition gets a fencing token higher than all of the ones before it.
+	Fence int64
+
+	// Version is incremented on every write, so that concurrent writers can't
+	// overwrite each other's changes
+	Version int64
+
+	// ExpiresAt is when the last of the leases on the lock runs out, in epoch seconds,
+	// so that it can be used as the table's TTL attribute. It's not set when nobody
+	// holds the lock or when any of the holders has a lease that never expires.
+	ExpiresAt int64 `dynamodbav:",omitempty"`
+
+	// legacy is set on a lock that was loaded from an item written by an older
+	// version, see legacyItem. It's never written back.
+	legacy *legacyItem
+
+	// loadedFence is the Fence the lock was loaded with, so that its fenceCounter is
+	// only written when it went up
+	loadedFence int64
+}
+
+// prune removes every holder and intent whose lease has run out or that exceeded its
+// max-hold and every ticket that was abandoned, and returns the holders that were removed
+func (s *lockState) prune(now int64) map[string]*lockHolder {
+	pruned := map[string]*lockHolder{}
+	for token, holder := range s.Holders {
+		if holder.expired(now) || holder.overdue(now) {
+			pruned[token] = holder
+			delete(s.Holders, token)
+		}
+	}
+	for token, ticket := range s.Queue {
+		if ticket.ExpiresAt < now {
+			delete(s.Queue, token)
+		}
+	}
+	for token, ticket := range s.Below {
+		if ticket.ExpiresAt < now {
+			delete(s.Below, token)
+		}
+	}
+	for token, intent := range s.Intents {
+		if intent.ExpiresAt != 0 && intent.ExpiresAt < now {
+			delete(s.Intents, token)
+		}
+	}
+	return pruned
+}
+
+// queue returns the tokens of the waiting owners, in the order they get to acquire the
+// lock: highest priority first, and first come first served within the same priority
+func (s *lockState) queue() []string {
+	tokens := make([]string, 0, len(s.Queue))
+	for token := range s.Queue {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return s.Queue[tokens[i]].ahead(s.Queue[tokens[j]])
+	})
+	return tokens
+}
+
+// position returns where token is in the queue, starting at 1, or 0 if it isn't queued
+func (s *lockState) position(token string) int {
+	for i, t := range s.queue() {
+		if t == token {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// enqueue gives token a ticket behind everyone with the same or a higher priority
+// unless it already has one, and keeps the ticket from expiring until the given time
+func (s *lockState) enqueue(token, mode string, priority int, until int64) {
+	if s.Queue == nil {
+		s.Queue = map[string]*lockTicket{}
+	}
+	ticket, ok := s.Queue[token]
+	if !ok {
+		s.Tickets++
+		ticket = &lockTicket{Seq: s.Tickets, Mode: mode, Priority: priority}
+		s.Queue[token] = ticket
+	}
+	ticket.ExpiresAt = until
+}
+
+// dequeue removes the ticket of token, and reports whether it had one
+func (s *lockState) dequeue(token string) bool {
+	if _, ok := s.Queue[token]; !ok {
+		return false
+	}
+	delete(s.Queue, token)
+	return true
+}
+
+// admits reports whether token can acquire the lock in mode, given the current holders
+// and everyone queued ahead of it getting the lock first. Up to permits exclusive
+// holders can hold the lock at once, while there can be any number of shared holders
+// as long as there are no exclusive holders. Owners without a ticket go after
+// everyone that's queued.
+func (s *lockState) admits(token, mode string, permits int) bool {
+	exclusive, shared := 0, 0
+	for _, h := range s.Holders {
+		if h.Mode == ModeShared {
+			shared++
+		} else {
+			exclusive++
+		}
+	}
+	compatible := func(mode string) bool {
+		if mode == ModeShared {
+			return exclusive == 0
+		}
+		return shared == 0 && exclusive < permits
+	}
+
+	// Everyone ahead in the queue has to be able to get the lock along with us,
+	// so a waiting writer keeps any readers that queued after it out
+	for _, t := range s.queue() {
+		if t == token {
+			break
+		}
+		ahead := s.Queue[t].Mode
+		if !compatible(ahead) {
+			return false
+		}
+		if ahead == ModeShared {
+			shared++
+		} else {
+			exclusive++
+		}
+	}
+	return compatible(mode)
+}
+
+// grant adds holder under token and hands it the next fencing token, taking it out of the queue
+func (s *lockState) grant(token string, holder *lockHolder) {
+	if s.Holders == nil {
+		s.Holders = map[string]*lockHolder{}
+	}
+	s.Fence++
+	holder.Fence = s.Fence
+	holder.Holds = 1
+	s.Holders[token] = holder
+	s.dequeue(token)
+}
+
+// admitsBelow reports whether token can hold a lock below this one in mode, given
+// the current holders of this lock and everyone waiting for it ahead of token
+func (s *lockState) admitsBelow(token, mode string) bool {
+	for t, holder := range s.Holders {
+		if t != token && (mode == ModeExclusive || holder.Mode != ModeShared) {
+			return false
+		}
+	}
+	for t, ticket := range s.Queue {
+		if t != token && (mode == ModeExclusive || ticket.Mode != ModeShared) && ticket.ahead(s.Below[token]) {
+			return false
+		}
+	}
+	return true
+}
+
+// admitsAbove reports whether token can hold this lock in mode, given the owners of
+// the locks below it and everyone waiting for them ahead of token
+func (s *lockState) admitsAbove(token, mode string) bool {
+	for t, intent := range s.Intents {
+		if t != token && (mode == ModeExclusive || intent.Mode != ModeShared) {
+			return false
+		}
+	}
+	for t, ticket := range s.Below {
+		if t != token && (mode == ModeExclusive || ticket.Mode != ModeShared) && ticket.ahead(s.Queue[token]) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitBelow gives token a ticket for waiting on a lock below this one in mode unless
+// it already has one, and keeps the ticket from expiring until the given time. Waiting
+// for several locks below in different modes counts as waiting exclusive.
+func (s *lockState) waitBelow(token, mode string, priority int, until int64) {
+	if s.Below == nil {
+		s.Below = map[string]*lockTicket{}
+	}
+	ticket, ok := s.Below[token]
+	if !ok {
+		s.Tickets++
+		ticket = &lockTicket{Seq: s.Tickets, Mode: mode, Priority: priority}
+		s.Below[token] = ticket
+	}
+	if mode == ModeExclusive {
+		ticket.Mode = ModeExclusive
+	}
+	ticket.ExpiresAt = until
+}
+
+// stopWaitingBelow removes the ticket of token for the locks below this one, and
+// reports whether it had one
+func (s *lockState) stopWaitingBelow(token string) bool {
+	if _, ok := s.Below[token]; !ok {
+		return false
+	}
+	delete(s.Below, token)
+	return true
+}
+
+// addIntent records that token holds another lock below this one in mode, until expiresAt
+func (s *lockState) addIntent(token, mode string, expiresAt int64) {
+	if s.Intents == nil {
+		s.Intents = map[string]*lockIntent{}
+	}
+	intent, ok := s.Intents[token]
+	if !ok {
+		s.Intents[token] = &lockIntent{Mode: mode, Count: 1, ExpiresAt: expiresAt}
+		return
+	}
+
+	intent.Count++
+	if mode == ModeExclusive {
+		intent.Mode = ModeExclusive
+	}
+	if intent.ExpiresAt != 0 && (expiresAt == 0 || expiresAt > intent.ExpiresAt) {
+		intent.ExpiresAt = expiresAt
+	}
+}
+
+// removeIntent records that token released one of the locks it held below this one
+func (s *lockState) removeIntent(token string) {
+	intent, ok := s.Intents[token]
+	if !ok {
+		return
+	}
+	intent.Count--
+	if intent.Count < 1 {
+		delete(s.Intents, token)
+	}
+}
+
+// reentrant returns the token of the holder that an owner in scope can re-enter the
+// lock through in mode, if there is one. A shared hold can't be re-entered as exclusive.
+func (s *lockState) reentrant(scope, mode string) string {
+	if scope == "" {
+		return ""
+	}
+	// When several holders are in the scope, the one that acquired the lock first is
+	// re-entered, so that every owner in the scope picks the same one
+	reentrant := ""
+	for token, holder := range s.Holders {
+		if holder.Scope != scope || (holder.Mode == ModeShared && mode != ModeShared) {
+			continue
+		}
+		if reentrant == "" || holder.Fence < s.Holders[reentrant].Fence {
+			reentrant = token
+		}
+	}
+	return reentrant
+}
+
+// reenter adds a hold to the holder with token, keeping its lease until at least
+// expiresAt and letting it hold the lock until at least holdUntil, and returns the holder
+func (s *lockState) reenter(token string, expiresAt, holdUntil int64) *lockHolder {
+	holder := s.Holders[token]
+	holder.Holds = holder.holds() + 1
+	if holder.ExpiresAt != 0 && (expiresAt == 0 || expiresAt > holder.ExpiresAt) {
+		holder.ExpiresAt = expiresAt
+	}
+	if holder.HoldUntil != 0 && (holdUntil == 0 || holdUntil > holder.HoldUntil) {
+		holder.HoldUntil = holdUntil
+	}
+	return holder
+}
+
+// release takes away a hold from the holder with token, removing the holder once its
+// last hold is released, and reports whether it held the lock
+func (s *lockState) release(token string) bool {
+	holder, ok := s.Holders[token]
+	if !ok {
+		return false
+	}
+	if holder.holds() > 1 {
+		holder.Holds--
+		return true
+	}
+	delete(s.Holders, token)
+	return true
+}
+
+// expiry is the value for ExpiresAt based on the current holders
+func (s *lockState) expiry() int64 {
+	var expiresAt int64
+	for _, holder := range s.Holders {
+		deadline := holder.deadline()
+		if deadline == 0 {
+			return 0
+		}
+		if deadline > expiresAt {
+			expiresAt = deadline
+		}
+	}
+	return expiresAt
+}
@@ -0,0 +1,166 @@
+package main
+
+import "testing"
+
+// queued is a ticket in the queue of a test lock, in the order they were handed out
+type queued struct {
+	token    string
+	mode     string
+	priority int
+}
+
+// testState returns a lock held by holders in the given modes, keyed by token, with
+// tickets handed out to queue in order
+func testState(holders map[string]string, queue ...queued) *lockState {
+	state := &lockState{}
+	for token, mode := range holders {
+		state.grant(token, &lockHolder{Mode: mode})
+	}
+	for _, ticket := range queue {
+		state.enqueue(ticket.token, ticket.mode, ticket.priority, 0)
+	}
+	return state
+}
+
+func TestLockStateAdmits(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    *lockState
+		token    string
+		mode     string
+		permits  int
+		expected bool
+	}{
+		{
+			name:     "free lock",
+			state:    testState(nil),
+			token:    "a",
+			mode:     ModeExclusive,
+			permits:  1,
+			expected: true,
+		},
+		{
+			name:     "single permit taken",
+			state:    testState(map[string]string{"a": ModeExclusive}),
+			token:    "b",
+			mode:     ModeExclusive,
+			permits:  1,
+			expected: false,
+		},
+		{
+			name:     "permits left",
+			state:    testState(map[string]string{"a": ModeExclusive, "b": ModeExclusive}),
+			token:    "c",
+			mode:     ModeExclusive,
+			permits:  3,
+			expected: true,
+		},
+		{
+			name:     "all permits taken",
+			state:    testState(map[string]string{"a": ModeExclusive, "b": ModeExclusive, "c": ModeExclusive}),
+			token:    "d",
+			mode:     ModeExclusive,
+			permits:  3,
+			expected: false,
+		},
+		{
+			name:     "queued ahead take the permits left",
+			state:    testState(map[string]string{"a": ModeExclusive}, queued{"b", ModeExclusive, 0}, queued{"c", ModeExclusive, 0}),
+			token:    "c",
+			mode:     ModeExclusive,
+			permits:  2,
+			expected: false,
+		},
+		{
+			name:     "shared holders coexist",
+			state:    testState(map[string]string{"a": ModeShared, "b": ModeShared}),
+			token:    "c",
+			mode:     ModeShared,
+			permits:  1,
+			expected: true,
+		},
+		{
+			name:     "shared holders exclude exclusive",
+			state:    testState(map[string]string{"a": ModeShared}),
+			token:    "b",
+			mode:     ModeExclusive,
+			permits:  2,
+			expected: false,
+		},
+		{
+			name:     "exclusive holder excludes shared",
+			state:    testState(map[string]string{"a": ModeExclusive}),
+			token:    "b",
+			mode:     ModeShared,
+			permits:  2,
+			expected: false,
+		},
+		{
+			name:     "queued writer keeps later readers out",
+			state:    testState(map[string]string{"a": ModeShared}, queued{"b", ModeExclusive, 0}, queued{"c", ModeShared, 0}),
+			token:    "c",
+			mode:     ModeShared,
+			permits:  1,
+			expected: false,
+		},
+		{
+			name:     "readers without a ticket queue behind a writer",
+			state:    testState(map[string]string{"a": ModeShared}, queued{"b", ModeExclusive, 0}),
+			token:    "c",
+			mode:     ModeShared,
+			permits:  1,
+			expected: false,
+		},
+		{
+			name:     "readers queued ahead of a writer share",
+			state:    testState(map[string]string{"a": ModeShared}, queued{"b", ModeShared, 0}, queued{"c", ModeShared, 0}, queued{"d", ModeExclusive, 0}),
+			token:    "c",
+			mode:     ModeShared,
+			permits:  1,
+			expected: true,
+		},
+		{
+			name:     "writer waits for the readers queued ahead",
+			state:    testState(nil, queued{"a", ModeShared, 0}, queued{"b", ModeExclusive, 0}),
+			token:    "b",
+			mode:     ModeExclusive,
+			permits:  1,
+			expected: false,
+		},
+		{
+			name:     "higher priority goes ahead of earlier tickets",
+			state:    testState(nil, queued{"a", ModeExclusive, 0}, queued{"b", ModeExclusive, 10}),
+			token:    "b",
+			mode:     ModeExclusive,
+			permits:  1,
+			expected: true,
+		},
+	}
+	for _, test := range tests {
+		if got := test.state.admits(test.token, test.mode, test.permits); got != test.expected {
+			t.Errorf("%s: admits(%q, %s, %d) = %v, expected %v", test.name, test.token, test.mode, test.permits, got, test.expected)
+		}
+	}
+}
+
+func TestLockStateReentrant(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		state := &lockState{}
+		for _, token := range []string{"a", "b", "c", "d"} {
+			state.grant(token, &lockHolder{Mode: ModeExclusive, Scope: "run-1"})
+		}
+		state.grant("e", &lockHolder{Mode: ModeExclusive, Scope: "run-2"})
+		if got := state.reentrant("run-1", ModeExclusive); got != "a" {
+			t.Fatalf("expected the holder that acquired the lock first to be re-entered, got %q", got)
+		}
+	}
+
+	state := testState(map[string]string{"a": ModeShared})
+	state.Holders["a"].Scope = "run-1"
+	if got := state.reentrant("run-1", ModeExclusive); got != "" {
+		t.Errorf("expected a shared hold not to be re-entered as exclusive, got %q", got)
+	}
+	if got := state.reentrant("", ModeShared); got != "" {
+		t.Errorf("expected no re-entry without a scope, got %q", got)
+	}
+}